@@ -0,0 +1,111 @@
+package IridiumStore
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	"strings"
+)
+
+// MySQL schema. 'log' matches the table the server has always written to, so existing databases are kept.
+// Those predate the ID column, which upgradeMySQLLog() adds before the migrations run.
+var mysqlMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS log (
+		ID BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		IMEI VARCHAR(15) NOT NULL,
+		MOMSN VARCHAR(16) NOT NULL,
+		TransmitTime VARCHAR(32) NOT NULL,
+		IridiumLat VARCHAR(16) NOT NULL,
+		IridiumLng VARCHAR(16) NOT NULL,
+		IridiumCEP VARCHAR(16) NOT NULL,
+		InsertTime DATETIME NOT NULL,
+		TransmitInitTime DATETIME NOT NULL,
+		GPSLat VARCHAR(16) NOT NULL,
+		GPSLng VARCHAR(16) NOT NULL,
+		Data BLOB NOT NULL,
+		INDEX (IMEI, InsertTime)
+	)`,
+	`CREATE TABLE IF NOT EXISTS devices (
+		IMEI VARCHAR(15) NOT NULL PRIMARY KEY,
+		Name VARCHAR(64) NOT NULL DEFAULT '',
+		Allowed TINYINT(1) NOT NULL DEFAULT 1,
+		CreditBudget INT NOT NULL DEFAULT 0,
+		CreditsUsed INT NOT NULL DEFAULT 0,
+		ReplyFormat VARCHAR(16) NOT NULL DEFAULT 'text'
+	)`,
+	// Delivery state, so retried deliveries are neither logged nor answered twice. Existing rows are done.
+	`ALTER TABLE log ADD COLUMN State INT NOT NULL DEFAULT 1`,
+	`ALTER TABLE log ADD COLUMN RepliesSent INT NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS mt_queue (
+		ID BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		LogID BIGINT NOT NULL,
+		IMEI VARCHAR(15) NOT NULL,
+		Data BLOB NOT NULL,
+		State INT NOT NULL,
+		Attempts INT NOT NULL,
+		CreateTime DATETIME NOT NULL,
+		NextAttempt DATETIME NOT NULL,
+		SentTime DATETIME NOT NULL,
+		MessageID VARCHAR(32) NOT NULL,
+		ErrorCode INT NOT NULL,
+		Error VARCHAR(255) NOT NULL,
+		INDEX (State, ID),
+		INDEX (IMEI, ID)
+	)`,
+	// CreditBudget is per month from here on.
+	`ALTER TABLE devices ADD COLUMN CreditsMonth VARCHAR(7) NOT NULL DEFAULT ''`,
+}
+
+func NewMySQLStore(dsn string) (Store, error) {
+	// DATETIME columns are scanned into time.Time.
+	if !strings.Contains(dsn, "parseTime=") {
+		if strings.Contains(dsn, "?") {
+			dsn += "&parseTime=true"
+		} else {
+			dsn += "?parseTime=true"
+		}
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("NewMySQLStore(): %s", err.Error())
+	}
+	if err := upgradeMySQLLog(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("NewMySQLStore(): %s", err.Error())
+	}
+	if err := migrate(db, mysqlMigrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("NewMySQLStore(): %s", err.Error())
+	}
+	return &sqlStore{db: db}, nil
+}
+
+/*
+	upgradeMySQLLog().
+	 The 'log' table written by earlier versions of the server has no ID column, and the first
+	 migration's CREATE TABLE IF NOT EXISTS leaves it that way. Adds the column to an existing table
+	 that is missing it. Runs on every start, as the table may have been kept through migration 1.
+*/
+
+func upgradeMySQLLog(db *sql.DB) error {
+	var tables, idColumns int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.tables WHERE table_schema=DATABASE() AND table_name='log'`).Scan(&tables)
+	if err != nil {
+		return fmt.Errorf("upgradeMySQLLog(): %s", err.Error())
+	}
+	if tables == 0 {
+		return nil // New database, created by the migrations.
+	}
+	err = db.QueryRow(`SELECT COUNT(*) FROM information_schema.columns WHERE table_schema=DATABASE() AND table_name='log' AND column_name='ID'`).Scan(&idColumns)
+	if err != nil {
+		return fmt.Errorf("upgradeMySQLLog(): %s", err.Error())
+	}
+	if idColumns > 0 {
+		return nil
+	}
+	fmt.Printf("Adding the ID column to the existing 'log' table.\n")
+	if _, err := db.Exec(`ALTER TABLE log ADD COLUMN ID BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY FIRST, ADD INDEX (IMEI, InsertTime)`); err != nil {
+		return fmt.Errorf("upgradeMySQLLog(): The existing 'log' table has no ID column and it can't be added (%s). Add it by hand with 'ALTER TABLE log ADD COLUMN ID BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY FIRST' and restart.", err.Error())
+	}
+	return nil
+}
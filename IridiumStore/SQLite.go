@@ -0,0 +1,68 @@
+package IridiumStore
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS log (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		IMEI TEXT NOT NULL,
+		MOMSN TEXT NOT NULL,
+		TransmitTime TEXT NOT NULL,
+		IridiumLat TEXT NOT NULL,
+		IridiumLng TEXT NOT NULL,
+		IridiumCEP TEXT NOT NULL,
+		InsertTime DATETIME NOT NULL,
+		TransmitInitTime DATETIME NOT NULL,
+		GPSLat TEXT NOT NULL,
+		GPSLng TEXT NOT NULL,
+		Data BLOB NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS devices (
+		IMEI TEXT NOT NULL PRIMARY KEY,
+		Name TEXT NOT NULL DEFAULT '',
+		Allowed INTEGER NOT NULL DEFAULT 1,
+		CreditBudget INTEGER NOT NULL DEFAULT 0,
+		CreditsUsed INTEGER NOT NULL DEFAULT 0,
+		ReplyFormat TEXT NOT NULL DEFAULT 'text'
+	)`,
+	`CREATE INDEX IF NOT EXISTS log_imei_time ON log (IMEI, InsertTime)`,
+	// Delivery state, so retried deliveries are neither logged nor answered twice. Existing rows are done.
+	`ALTER TABLE log ADD COLUMN State INT NOT NULL DEFAULT 1`,
+	`ALTER TABLE log ADD COLUMN RepliesSent INT NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS mt_queue (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		LogID INTEGER NOT NULL,
+		IMEI TEXT NOT NULL,
+		Data BLOB NOT NULL,
+		State INTEGER NOT NULL,
+		Attempts INTEGER NOT NULL,
+		CreateTime DATETIME NOT NULL,
+		NextAttempt DATETIME NOT NULL,
+		SentTime DATETIME NOT NULL,
+		MessageID TEXT NOT NULL,
+		ErrorCode INTEGER NOT NULL,
+		Error TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS mt_queue_state ON mt_queue (State, ID)`,
+	// CreditBudget is per month from here on.
+	`ALTER TABLE devices ADD COLUMN CreditsMonth TEXT NOT NULL DEFAULT ''`,
+}
+
+// NewSQLiteStore opens (or creates) the database file at 'path'.
+func NewSQLiteStore(path string) (Store, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("NewSQLiteStore(): %s", err.Error())
+	}
+	// One writer at a time, SQLite locks the whole file.
+	db.SetMaxOpenConns(1)
+	if err := migrate(db, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("NewSQLiteStore(): %s", err.Error())
+	}
+	return &sqlStore{db: db}, nil
+}
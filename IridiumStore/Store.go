@@ -0,0 +1,348 @@
+package IridiumStore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Log entry states.
+const (
+	LOG_STATE_RECEIVED = 0 // Logged, not finished processing. A retried delivery picks it up again.
+	LOG_STATE_DONE     = 1 // Processed and answered (or nothing to answer).
+)
+
+// LogEntry is one received MO message, as posted by RockBLOCK plus what was decoded from it.
+type LogEntry struct {
+	ID               int64
+	IMEI             string
+	MOMSN            string
+	TransmitTime     string // As sent by RockBLOCK, "yy-mm-dd hh:mm:ss".
+	IridiumLat       string
+	IridiumLng       string
+	IridiumCEP       string
+	InsertTime       time.Time
+	TransmitInitTime time.Time // From the message. Zero if not present.
+	GPSLat           string    // From the message. Empty if not present.
+	GPSLng           string
+	Data             string
+	State            int // LOG_STATE_*.
+	RepliesSent      int // MT replies sent so far.
+}
+
+// Outbound (MT) message states.
+const (
+	MT_STATE_QUEUED = 0 // Waiting to be sent, or to be retried at NextAttempt.
+	MT_STATE_SENT   = 1 // Accepted by RockBLOCK.
+	MT_STATE_FAILED = 2 // Given up on.
+)
+
+// MTMessage is a queued reply to a device. Messages for one device are sent in ID order.
+type MTMessage struct {
+	ID          int64
+	LogID       int64 // Log entry of the request being answered. 0 if none.
+	IMEI        string
+	Data        []byte
+	State       int // MT_STATE_*.
+	Attempts    int
+	CreateTime  time.Time
+	NextAttempt time.Time
+	SentTime    time.Time // Zero until sent.
+	MessageID   string    // Assigned by RockBLOCK when sent.
+	ErrorCode   int       // RockBLOCK error code of the last failure, 0 if none or not a RockBLOCK error.
+	Error       string    // Last failure.
+}
+
+// MTQuery selects queued messages. Empty/zero fields are not used to filter.
+type MTQuery struct {
+	IMEI  string
+	State int // MT_STATE_*, -1 = any.
+	Limit int // Maximum number of messages, newest first. 0 = no limit.
+}
+
+// Device is a registered device. Uplinks from IMEIs not registered, or not allowed, are rejected.
+type Device struct {
+	IMEI         string
+	Name         string
+	Allowed      bool
+	CreditBudget int    // Credits replies may use each calendar month (UTC). 0 = no limit.
+	CreditsUsed  int    // Used in CreditsMonth.
+	CreditsMonth string // "2006-01".
+	ReplyFormat  string // "text" or "packed".
+}
+
+// LogQuery selects log entries. Empty/zero fields are not used to filter.
+type LogQuery struct {
+	IMEI  string
+	From  time.Time // InsertTime >= From.
+	To    time.Time // InsertTime < To.
+	Limit int       // Maximum number of entries, oldest first. 0 = no limit.
+}
+
+type Store interface {
+	InsertLog(e LogEntry) (int64, error) // Returns the new entry's ID.
+	UpdateLogState(id int64, state, repliesSent int) error
+	GetDevice(imei string) (*Device, error)                       // nil if not registered. CreditsUsed is for the current month.
+	UseDeviceCredits(imei string, credits int, t time.Time) error // Adds to the credits used in the month of 't'.
+	QueryLog(q LogQuery) ([]LogEntry, error)
+	FindLog(imei, momsn string, since time.Time) (*LogEntry, error) // Latest entry for 'imei' and 'momsn' since 'since', nil if none.
+	QueueMT(logID int64, imei string, data [][]byte) error          // Queues replies to log entry 'logID' and marks it LOG_STATE_DONE.
+	PendingMT() ([]MTMessage, error)                                // All MT_STATE_QUEUED messages, in ID order.
+	UpdateMT(m MTMessage) error                                     // Saves State, Attempts, NextAttempt, SentTime, MessageID, ErrorCode and Error.
+	QueryMT(q MTQuery) ([]MTMessage, error)
+	Close() error
+}
+
+/*
+	sqlStore.
+	 Store on top of database/sql. The backends only differ in how they connect and in their
+	 schema, the queries themselves are plain SQL that both MySQL and SQLite accept.
+*/
+
+type sqlStore struct {
+	db *sql.DB
+}
+
+/*
+	migrate().
+	 Brings the schema up to date. 'migrations' are applied in order, the number applied so far
+	 is kept in the 'schema_version' table. Never edit or reorder a migration once released,
+	 only append new ones.
+*/
+
+func migrate(db *sql.DB, migrations []string) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (Version INT NOT NULL)`); err != nil {
+		return fmt.Errorf("migrate(): %s", err.Error())
+	}
+	version := 0
+	err := db.QueryRow(`SELECT Version FROM schema_version`).Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err := db.Exec(`INSERT INTO schema_version (Version) VALUES (0)`); err != nil {
+			return fmt.Errorf("migrate(): %s", err.Error())
+		}
+	} else if err != nil {
+		return fmt.Errorf("migrate(): %s", err.Error())
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("migrate(): Schema version %d is newer than this program (%d).", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("migrate(): %s", err.Error())
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate(): Migration %d: %s", i+1, err.Error())
+		}
+		if _, err := tx.Exec(`UPDATE schema_version SET Version=?`, i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate(): Migration %d: %s", i+1, err.Error())
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migrate(): Migration %d: %s", i+1, err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) InsertLog(e LogEntry) (int64, error) {
+	if e.InsertTime.IsZero() {
+		e.InsertTime = time.Now()
+	}
+	res, err := s.db.Exec(`INSERT INTO log (IMEI, MOMSN, TransmitTime, IridiumLat, IridiumLng, IridiumCEP, InsertTime, TransmitInitTime, GPSLat, GPSLng, Data, State, RepliesSent) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.IMEI, e.MOMSN, e.TransmitTime, e.IridiumLat, e.IridiumLng, e.IridiumCEP, e.InsertTime, e.TransmitInitTime, e.GPSLat, e.GPSLng, e.Data, e.State, e.RepliesSent)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *sqlStore) UpdateLogState(id int64, state, repliesSent int) error {
+	_, err := s.db.Exec(`UPDATE log SET State=?, RepliesSent=? WHERE ID=?`, state, repliesSent, id)
+	return err
+}
+
+func (s *sqlStore) GetDevice(imei string) (*Device, error) {
+	d := new(Device)
+	err := s.db.QueryRow(`SELECT IMEI, Name, Allowed, CreditBudget, CreditsUsed, CreditsMonth, ReplyFormat FROM devices WHERE IMEI=?`, imei).Scan(
+		&d.IMEI, &d.Name, &d.Allowed, &d.CreditBudget, &d.CreditsUsed, &d.CreditsMonth, &d.ReplyFormat)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Nothing used yet this month.
+	if month := creditsMonth(time.Now()); d.CreditsMonth != month {
+		d.CreditsUsed = 0
+		d.CreditsMonth = month
+	}
+	return d, nil
+}
+
+func creditsMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// UseDeviceCredits starts the count again when the month changes.
+func (s *sqlStore) UseDeviceCredits(imei string, credits int, t time.Time) error {
+	month := creditsMonth(t)
+	_, err := s.db.Exec(`UPDATE devices SET CreditsUsed=CASE WHEN CreditsMonth=? THEN CreditsUsed+? ELSE ? END, CreditsMonth=? WHERE IMEI=?`,
+		month, credits, credits, month, imei)
+	return err
+}
+
+const logColumns = `ID, IMEI, MOMSN, TransmitTime, IridiumLat, IridiumLng, IridiumCEP, InsertTime, TransmitInitTime, GPSLat, GPSLng, Data, State, RepliesSent`
+
+func scanLogEntry(rows *sql.Rows) (*LogEntry, error) {
+	e := new(LogEntry)
+	err := rows.Scan(&e.ID, &e.IMEI, &e.MOMSN, &e.TransmitTime, &e.IridiumLat, &e.IridiumLng, &e.IridiumCEP, &e.InsertTime, &e.TransmitInitTime, &e.GPSLat, &e.GPSLng, &e.Data, &e.State, &e.RepliesSent)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (s *sqlStore) QueryLog(q LogQuery) ([]LogEntry, error) {
+	query := `SELECT ` + logColumns + ` FROM log WHERE 1=1`
+	args := make([]interface{}, 0)
+	if len(q.IMEI) > 0 {
+		query += ` AND IMEI=?`
+		args = append(args, q.IMEI)
+	}
+	if !q.From.IsZero() {
+		query += ` AND InsertTime>=?`
+		args = append(args, q.From)
+	}
+	if !q.To.IsZero() {
+		query += ` AND InsertTime<?`
+		args = append(args, q.To)
+	}
+	query += ` ORDER BY InsertTime, ID`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]LogEntry, 0)
+	for rows.Next() {
+		e, err := scanLogEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *e)
+	}
+	return ret, rows.Err()
+}
+
+func (s *sqlStore) FindLog(imei, momsn string, since time.Time) (*LogEntry, error) {
+	rows, err := s.db.Query(`SELECT `+logColumns+` FROM log WHERE IMEI=? AND MOMSN=? AND InsertTime>=? ORDER BY InsertTime DESC, ID DESC LIMIT 1`, imei, momsn, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanLogEntry(rows)
+}
+
+/*
+	QueueMT().
+	 Queues 'data' and marks the log entry done in one transaction, so a retried delivery either
+	 finds its replies queued or nothing at all.
+*/
+
+func (s *sqlStore) QueueMT(logID int64, imei string, data [][]byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, d := range data {
+		_, err := tx.Exec(`INSERT INTO mt_queue (LogID, IMEI, Data, State, Attempts, CreateTime, NextAttempt, SentTime, MessageID, ErrorCode, Error) VALUES (?, ?, ?, ?, 0, ?, ?, ?, '', 0, '')`,
+			logID, imei, d, MT_STATE_QUEUED, now, now, time.Time{})
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if logID != 0 {
+		if _, err := tx.Exec(`UPDATE log SET State=?, RepliesSent=RepliesSent+? WHERE ID=?`, LOG_STATE_DONE, len(data), logID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const mtColumns = `ID, LogID, IMEI, Data, State, Attempts, CreateTime, NextAttempt, SentTime, MessageID, ErrorCode, Error`
+
+func (s *sqlStore) queryMT(query string, args ...interface{}) ([]MTMessage, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]MTMessage, 0)
+	for rows.Next() {
+		var m MTMessage
+		err := rows.Scan(&m.ID, &m.LogID, &m.IMEI, &m.Data, &m.State, &m.Attempts, &m.CreateTime, &m.NextAttempt, &m.SentTime, &m.MessageID, &m.ErrorCode, &m.Error)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, rows.Err()
+}
+
+func (s *sqlStore) PendingMT() ([]MTMessage, error) {
+	return s.queryMT(`SELECT `+mtColumns+` FROM mt_queue WHERE State=? ORDER BY ID`, MT_STATE_QUEUED)
+}
+
+func (s *sqlStore) UpdateMT(m MTMessage) error {
+	_, err := s.db.Exec(`UPDATE mt_queue SET State=?, Attempts=?, NextAttempt=?, SentTime=?, MessageID=?, ErrorCode=?, Error=? WHERE ID=?`,
+		m.State, m.Attempts, m.NextAttempt, m.SentTime, m.MessageID, m.ErrorCode, m.Error, m.ID)
+	return err
+}
+
+func (s *sqlStore) QueryMT(q MTQuery) ([]MTMessage, error) {
+	query := `SELECT ` + mtColumns + ` FROM mt_queue WHERE 1=1`
+	args := make([]interface{}, 0)
+	if len(q.IMEI) > 0 {
+		query += ` AND IMEI=?`
+		args = append(args, q.IMEI)
+	}
+	if q.State >= 0 {
+		query += ` AND State=?`
+		args = append(args, q.State)
+	}
+	query += ` ORDER BY ID DESC`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+	return s.queryMT(query, args...)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// Open opens the store for 'backend' ("mysql" or "sqlite"). 'dsn' is a MySQL DSN or an SQLite file path.
+func Open(backend, dsn string) (Store, error) {
+	switch backend {
+	case "mysql":
+		return NewMySQLStore(dsn)
+	case "sqlite":
+		return NewSQLiteStore(dsn)
+	}
+	return nil, fmt.Errorf("Unknown store backend '%s'.", backend)
+}
@@ -0,0 +1,150 @@
+package IridiumStore
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Track point position sources.
+const (
+	SOURCE_GPS     = "gps"
+	SOURCE_IRIDIUM = "iridium"
+)
+
+type TrackPoint struct {
+	Time   time.Time
+	Lat    float64
+	Lng    float64
+	Source string  // SOURCE_*.
+	CEP    float64 // Iridium position uncertainty, km. 0 for GPS positions.
+	MOMSN  string
+}
+
+/*
+	TrackFromLog().
+	 Builds a device track from its log entries, oldest first. Uses the GPS position reported in the
+	 message where there is one, otherwise the Iridium network's estimate with its CEP.
+	 Entries with neither are skipped.
+*/
+
+func TrackFromLog(entries []LogEntry) []TrackPoint {
+	ret := make([]TrackPoint, 0)
+	for _, e := range entries {
+		p := TrackPoint{Time: e.InsertTime, MOMSN: e.MOMSN}
+		if !e.TransmitInitTime.IsZero() {
+			p.Time = e.TransmitInitTime
+		}
+		lat, err1 := strconv.ParseFloat(e.GPSLat, 64)
+		lng, err2 := strconv.ParseFloat(e.GPSLng, 64)
+		if err1 == nil && err2 == nil {
+			p.Lat, p.Lng, p.Source = lat, lng, SOURCE_GPS
+		} else {
+			lat, err1 = strconv.ParseFloat(e.IridiumLat, 64)
+			lng, err2 = strconv.ParseFloat(e.IridiumLng, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			p.Lat, p.Lng, p.Source = lat, lng, SOURCE_IRIDIUM
+			p.CEP, _ = strconv.ParseFloat(e.IridiumCEP, 64)
+		}
+		ret = append(ret, p)
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Time.Before(ret[j].Time) })
+	return ret
+}
+
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+// MarshalTrackGeoJSON encodes the track as a FeatureCollection: one LineString for the whole track, then a Point for each position.
+// The LineString is left out for fewer than two positions, GeoJSON doesn't allow a shorter one.
+func MarshalTrackGeoJSON(imei string, points []TrackPoint) ([]byte, error) {
+	fc := geoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]geoJSONFeature, 0)}
+
+	if len(points) >= 2 {
+		line := make([][]float64, 0)
+		for _, p := range points {
+			line = append(line, []float64{p.Lng, p.Lat})
+		}
+		fc.Features = append(fc.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONGeometry{Type: "LineString", Coordinates: line},
+			Properties: map[string]interface{}{"imei": imei},
+		})
+	}
+
+	for _, p := range points {
+		props := map[string]interface{}{
+			"imei":   imei,
+			"momsn":  p.MOMSN,
+			"time":   p.Time.UTC().Format(time.RFC3339),
+			"source": p.Source,
+		}
+		if p.Source == SOURCE_IRIDIUM {
+			props["cep_km"] = p.CEP
+		}
+		fc.Features = append(fc.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONGeometry{Type: "Point", Coordinates: []float64{p.Lng, p.Lat}},
+			Properties: props,
+		})
+	}
+	return json.Marshal(fc)
+}
+
+type gpxTrackPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Time string  `xml:"time"`
+	Cmt  string  `xml:"cmt,omitempty"`
+	Src  string  `xml:"src"`
+}
+
+type gpx struct {
+	XMLName xml.Name        `xml:"gpx"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Version string          `xml:"version,attr"`
+	Creator string          `xml:"creator,attr"`
+	Name    string          `xml:"trk>name"`
+	Points  []gpxTrackPoint `xml:"trk>trkseg>trkpt"`
+}
+
+// MarshalTrackGPX encodes the track as a GPX 1.1 track. Iridium positions have their CEP in the comment.
+func MarshalTrackGPX(imei string, points []TrackPoint) ([]byte, error) {
+	g := gpx{
+		Xmlns:   "http://www.topografix.com/GPX/1/1",
+		Version: "1.1",
+		Creator: "weatherserver",
+		Name:    imei,
+		Points:  make([]gpxTrackPoint, 0),
+	}
+	for _, p := range points {
+		tp := gpxTrackPoint{Lat: p.Lat, Lon: p.Lng, Time: p.Time.UTC().Format(time.RFC3339), Src: p.Source}
+		if p.Source == SOURCE_IRIDIUM {
+			tp.Cmt = fmt.Sprintf("CEP %.1f km", p.CEP)
+		}
+		g.Points = append(g.Points, tp)
+	}
+	ret, err := xml.MarshalIndent(g, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), ret...), nil
+}
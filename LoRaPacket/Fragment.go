@@ -0,0 +1,125 @@
+package LoRaPacket
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// Every fragment on the air is prefixed with a header of MessageID (2 bytes, big endian), UniqIDHash (2 bytes, big endian),
+// Index (1 byte), Count (1 byte) and the length of the fragment data (1 byte).
+// Several fragments may share a single LoRa packet, one after the other.
+const (
+	FRAGMENT_HEADER_SIZE = 7
+	MAX_FRAGMENTS        = 255
+)
+
+type Fragment struct {
+	MessageID  uint16 // Changes whenever the contents behind a UniqID change.
+	UniqIDHash uint16 // HashUniqID() of the message's UniqID.
+	Index      uint8  // Position of this fragment in the message, 0 to Count-1.
+	Count      uint8  // Total number of fragments making up the message.
+	Data       []byte
+}
+
+// HashUniqID folds a 32-bit FNV-1a hash of the UniqID down to 16 bits.
+func HashUniqID(uniqID string) uint16 {
+	h := fnv.New32a()
+	h.Write([]byte(uniqID))
+	s := h.Sum32()
+	return uint16(s>>16) ^ uint16(s&0xFFFF)
+}
+
+/*
+	FragmentMessage().
+	 Splits 'msg' into fragments that each fit (with header) into a packet of 'maxPacketSize' bytes.
+	 A message that fits in one packet is returned as a single fragment with Count=1.
+*/
+
+func FragmentMessage(msgID uint16, uniqID string, msg []byte, maxPacketSize int) ([]Fragment, error) {
+	payloadSize := maxPacketSize - FRAGMENT_HEADER_SIZE
+	if payloadSize > 255 {
+		payloadSize = 255 // Limited by the 1 byte length field.
+	}
+	if payloadSize <= 0 {
+		return nil, fmt.Errorf("FragmentMessage(): Packet size %d too small.", maxPacketSize)
+	}
+
+	count := (len(msg) + payloadSize - 1) / payloadSize
+	if count == 0 {
+		count = 1 // Empty message still needs a fragment.
+	}
+	if count > MAX_FRAGMENTS {
+		return nil, fmt.Errorf("FragmentMessage(): Message too long (%d bytes, %d fragments).", len(msg), count)
+	}
+
+	uniqIDHash := HashUniqID(uniqID)
+	ret := make([]Fragment, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * payloadSize
+		if end > len(msg) {
+			end = len(msg)
+		}
+		ret[i] = Fragment{
+			MessageID:  msgID,
+			UniqIDHash: uniqIDHash,
+			Index:      uint8(i),
+			Count:      uint8(count),
+			Data:       msg[i*payloadSize : end],
+		}
+	}
+	return ret, nil
+}
+
+func (f Fragment) Marshal() []byte {
+	ret := make([]byte, FRAGMENT_HEADER_SIZE, FRAGMENT_HEADER_SIZE+len(f.Data))
+	ret[0], ret[1] = byte(f.MessageID>>8), byte(f.MessageID&0xFF)
+	ret[2], ret[3] = byte(f.UniqIDHash>>8), byte(f.UniqIDHash&0xFF)
+	ret[4] = f.Index
+	ret[5] = f.Count
+	ret[6] = byte(len(f.Data))
+	return append(ret, f.Data...)
+}
+
+// ParseFragments splits a received packet back into the fragments it carries.
+func ParseFragments(pkt []byte) ([]Fragment, error) {
+	ret := make([]Fragment, 0)
+	for len(pkt) > 0 {
+		if len(pkt) < FRAGMENT_HEADER_SIZE {
+			return ret, fmt.Errorf("ParseFragments(): Truncated header (%d bytes).", len(pkt))
+		}
+		f := Fragment{
+			MessageID:  uint16(pkt[0])<<8 | uint16(pkt[1]),
+			UniqIDHash: uint16(pkt[2])<<8 | uint16(pkt[3]),
+			Index:      pkt[4],
+			Count:      pkt[5],
+		}
+		dataLen := int(pkt[6])
+		pkt = pkt[FRAGMENT_HEADER_SIZE:]
+		if f.Count == 0 || f.Index >= f.Count {
+			return ret, fmt.Errorf("ParseFragments(): Invalid fragment %d of %d.", f.Index, f.Count)
+		}
+		if len(pkt) < dataLen {
+			return ret, errors.New("ParseFragments(): Truncated fragment data.")
+		}
+		f.Data = pkt[:dataLen]
+		pkt = pkt[dataLen:]
+		ret = append(ret, f)
+	}
+	return ret, nil
+}
+
+// PackFragments lays fragments out in order into packets of at most 'maxPacketSize' bytes.
+func PackFragments(frags []Fragment, maxPacketSize int) [][]byte {
+	ret := make([][]byte, 0)
+	for _, f := range frags {
+		b := f.Marshal()
+		if len(ret) > 0 && len(ret[len(ret)-1])+len(b) <= maxPacketSize {
+			// Add this fragment to the end of the last packet.
+			ret[len(ret)-1] = append(ret[len(ret)-1], b...)
+		} else {
+			ret = append(ret, b)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,154 @@
+package LoRaPacket
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	FRAME_VERSION     = 1
+	MAX_UNIQID_LEN    = 255
+	MAX_FRAME_PAYLOAD = 65535
+	POSITION_SCALE    = 100000 // Lat/Lng fixed-point, 1e-5 degrees.
+)
+
+// Frame flags.
+const (
+	FRAME_FLAG_POSITION         = 0x01 // Position block follows Expiry.
+	FRAME_FLAG_ALTITUDE_UNKNOWN = 0x02 // Only with FRAME_FLAG_POSITION. The Altitude field is not valid and is sent as 0.
+	frameFlagsKnown             = FRAME_FLAG_POSITION | FRAME_FLAG_ALTITUDE_UNKNOWN
+)
+
+// Frame types. Tells the receiver how to interpret the payload.
+const (
+	FRAME_TYPE_NIL = iota
+	FRAME_TYPE_METAR
+	FRAME_TYPE_TAF
+	FRAME_TYPE_PIREP
+	FRAME_TYPE_NEXRAD
+	FRAME_TYPE_METAR_PACKED // WeatherPack.PackMETAR() output.
+)
+
+/*
+	Frame.
+	 Wraps every broadcast message before it is fragmented. On the air:
+	  Version (1 byte)
+	  Type (1 byte)
+	  Flags (1 byte, FRAME_FLAG_*)
+	  Length of UniqID (1 byte), UniqID
+	  Expiry (4 bytes, big endian, Unix seconds)
+	  If FRAME_FLAG_POSITION: Lat (4 bytes), Lng (4 bytes), both big endian 1e-5 degrees, Altitude (2 bytes, big endian, hundreds of feet MSL, 0 if FRAME_FLAG_ALTITUDE_UNKNOWN)
+	  Length of Payload (2 bytes, big endian), Payload
+*/
+
+type Position struct {
+	Lat             float64
+	Lng             float64
+	Altitude        int  // Feet MSL. Ignored if AltitudeUnknown.
+	AltitudeUnknown bool // No altitude was reported, e.g. a PIREP without a /FL field.
+}
+
+type Frame struct {
+	Type     uint8
+	UniqID   string
+	Expiry   time.Time
+	Position *Position // Optional. Used by reports tied to a point rather than a station, e.g. PIREPs.
+	Payload  []byte
+}
+
+func (f Frame) Marshal() ([]byte, error) {
+	if len(f.UniqID) > MAX_UNIQID_LEN {
+		return nil, fmt.Errorf("Frame.Marshal(): UniqID too long (%d bytes).", len(f.UniqID))
+	}
+	if len(f.Payload) > MAX_FRAME_PAYLOAD {
+		return nil, fmt.Errorf("Frame.Marshal(): Payload too long (%d bytes).", len(f.Payload))
+	}
+
+	var flags uint8
+	if f.Position != nil {
+		flags |= FRAME_FLAG_POSITION
+		if f.Position.AltitudeUnknown {
+			flags |= FRAME_FLAG_ALTITUDE_UNKNOWN
+		}
+	}
+
+	ret := make([]byte, 0, 20+len(f.UniqID)+len(f.Payload))
+	ret = append(ret, FRAME_VERSION, f.Type, flags)
+	ret = append(ret, byte(len(f.UniqID)))
+	ret = append(ret, []byte(f.UniqID)...)
+	expiry := uint32(f.Expiry.Unix())
+	ret = append(ret, byte(expiry>>24), byte(expiry>>16), byte(expiry>>8), byte(expiry))
+	if f.Position != nil {
+		lat := uint32(int32(math.Floor(f.Position.Lat*POSITION_SCALE + 0.5)))
+		lng := uint32(int32(math.Floor(f.Position.Lng*POSITION_SCALE + 0.5)))
+		var alt uint16
+		if !f.Position.AltitudeUnknown {
+			alt = uint16(int16(f.Position.Altitude / 100))
+		}
+		ret = append(ret, byte(lat>>24), byte(lat>>16), byte(lat>>8), byte(lat))
+		ret = append(ret, byte(lng>>24), byte(lng>>16), byte(lng>>8), byte(lng))
+		ret = append(ret, byte(alt>>8), byte(alt))
+	}
+	ret = append(ret, byte(len(f.Payload)>>8), byte(len(f.Payload)))
+	ret = append(ret, f.Payload...)
+	return ret, nil
+}
+
+// UnmarshalFrame decodes a reassembled message back into a Frame.
+func UnmarshalFrame(data []byte) (Frame, error) {
+	var ret Frame
+	if len(data) < 4 {
+		return ret, errors.New("UnmarshalFrame(): Frame too short.")
+	}
+	if data[0] != FRAME_VERSION {
+		return ret, fmt.Errorf("UnmarshalFrame(): Unsupported frame version %d.", data[0])
+	}
+	ret.Type = data[1]
+	flags := data[2]
+	if flags&^frameFlagsKnown != 0 {
+		return ret, fmt.Errorf("UnmarshalFrame(): Unsupported flags %02x.", flags)
+	}
+	if flags&FRAME_FLAG_ALTITUDE_UNKNOWN != 0 && flags&FRAME_FLAG_POSITION == 0 {
+		return ret, errors.New("UnmarshalFrame(): Altitude flag without a position.")
+	}
+	uniqIDLen := int(data[3])
+	data = data[4:]
+
+	headerLen := uniqIDLen + 6
+	if flags&FRAME_FLAG_POSITION != 0 {
+		headerLen += 10
+	}
+	if len(data) < headerLen {
+		return ret, errors.New("UnmarshalFrame(): Truncated header.")
+	}
+	ret.UniqID = string(data[:uniqIDLen])
+	data = data[uniqIDLen:]
+	expiry := uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+	ret.Expiry = time.Unix(int64(expiry), 0)
+	data = data[4:]
+	if flags&FRAME_FLAG_POSITION != 0 {
+		lat := int32(uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3]))
+		lng := int32(uint32(data[4])<<24 | uint32(data[5])<<16 | uint32(data[6])<<8 | uint32(data[7]))
+		alt := int16(uint16(data[8])<<8 | uint16(data[9]))
+		ret.Position = &Position{
+			Lat:      float64(lat) / POSITION_SCALE,
+			Lng:      float64(lng) / POSITION_SCALE,
+			Altitude: int(alt) * 100,
+		}
+		if flags&FRAME_FLAG_ALTITUDE_UNKNOWN != 0 {
+			ret.Position.Altitude = 0
+			ret.Position.AltitudeUnknown = true
+		}
+		data = data[10:]
+	}
+	payloadLen := int(data[0])<<8 | int(data[1])
+	data = data[2:]
+
+	if len(data) != payloadLen {
+		return ret, fmt.Errorf("UnmarshalFrame(): Payload length mismatch: expected %d, got %d.", payloadLen, len(data))
+	}
+	ret.Payload = data
+	return ret, nil
+}
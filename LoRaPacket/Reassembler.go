@@ -0,0 +1,118 @@
+package LoRaPacket
+
+import (
+	"sync"
+	"time"
+)
+
+type reassemblyKey struct {
+	MessageID  uint16
+	UniqIDHash uint16
+}
+
+type partialMessage struct {
+	fragments [][]byte
+	received  int
+	lastSeen  time.Time
+}
+
+/*
+	Reassembler.
+	 Receiver side of FragmentMessage(). Fragments can arrive in any order and missing fragments
+	 are filled in as the broadcaster repeats its send list. Once a message is complete it is
+	 returned once; repeats of the same MessageID are ignored until they have not been heard
+	 for 'Timeout'.
+*/
+
+type Reassembler struct {
+	Timeout   time.Duration
+	partial   map[reassemblyKey]*partialMessage
+	completed map[reassemblyKey]time.Time // Last time a fragment of an already delivered message was seen.
+	mu        *sync.Mutex
+}
+
+func NewReassembler(timeout time.Duration) *Reassembler {
+	r := new(Reassembler)
+	r.Timeout = timeout
+	r.partial = make(map[reassemblyKey]*partialMessage, 0)
+	r.completed = make(map[reassemblyKey]time.Time, 0)
+	r.mu = &sync.Mutex{}
+	return r
+}
+
+// AddPacket processes one received LoRa packet and returns any messages it completed.
+func (r *Reassembler) AddPacket(pkt []byte) ([][]byte, error) {
+	ret := make([][]byte, 0)
+	frags, err := ParseFragments(pkt)
+	// Use whatever fragments were parsed before any error.
+	for _, f := range frags {
+		if msg, ok := r.AddFragment(f); ok {
+			ret = append(ret, msg)
+		}
+	}
+	return ret, err
+}
+
+// AddFragment returns the full message and true if 'f' was the last missing fragment.
+// Fragments with an invalid Index or Count are ignored.
+func (r *Reassembler) AddFragment(f Fragment) ([]byte, bool) {
+	if f.Count == 0 || f.Index >= f.Count {
+		return nil, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := time.Now()
+	k := reassemblyKey{MessageID: f.MessageID, UniqIDHash: f.UniqIDHash}
+
+	if _, ok := r.completed[k]; ok {
+		// Already delivered, this is a repeat from a later broadcast cycle.
+		r.completed[k] = t
+		return nil, false
+	}
+
+	p, ok := r.partial[k]
+	if !ok || len(p.fragments) != int(f.Count) {
+		// New message, or the MessageID was reused with a different layout. Start over.
+		p = &partialMessage{fragments: make([][]byte, f.Count)}
+		r.partial[k] = p
+	}
+	p.lastSeen = t
+
+	if p.fragments[f.Index] == nil {
+		p.fragments[f.Index] = append([]byte{}, f.Data...) // Copy, the packet buffer may be reused.
+		p.received++
+	}
+
+	if p.received < len(p.fragments) {
+		return nil, false
+	}
+
+	// All fragments are here.
+	ret := make([]byte, 0)
+	for _, d := range p.fragments {
+		ret = append(ret, d...)
+	}
+	delete(r.partial, k)
+	r.completed[k] = t
+	return ret, true
+}
+
+// Prune forgets partial and delivered messages that have not been heard from in 'Timeout'.
+func (r *Reassembler) Prune() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := time.Now()
+	for k, p := range r.partial {
+		if t.Sub(p.lastSeen) > r.Timeout {
+			delete(r.partial, k)
+		}
+	}
+	for k, lastSeen := range r.completed {
+		if t.Sub(lastSeen) > r.Timeout {
+			delete(r.completed, k)
+		}
+	}
+}
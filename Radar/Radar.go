@@ -0,0 +1,243 @@
+package Radar
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	TILE_VERSION     = 1
+	TILE_HEADER_SIZE = 21
+	POSITION_SCALE   = 100000 // Origin lat/lng fixed-point, 1e-5 degrees.
+	SPAN_SCALE       = 1000   // Tile span fixed-point, 1e-3 degrees.
+	SM_PER_DEGREE    = 69.0   // Statute miles per degree of latitude.
+)
+
+// TileFetcher returns the compressed radar tile covering lat/lng and the time of the scan it was rendered from.
+type TileFetcher func(lat, lng float64) ([]byte, time.Time, error)
+
+/*
+	Tile.
+	 One tile of a radar frame set. Every tile carries the full description of the set so that
+	 a receiver can place it without having heard any other tile. On the air:
+	  Version (1 byte)
+	  FrameID (2 bytes, big endian)
+	  Time (4 bytes, big endian, Unix seconds)
+	  Rows, Cols (1 byte each)
+	  Row, Col (1 byte each)
+	  OriginLat, OriginLng (4 bytes each, big endian, 1e-5 degrees)
+	  TileSpan (2 bytes, big endian, 1e-3 degrees)
+	  Data
+*/
+
+type Tile struct {
+	FrameID   uint16    // Identifies the frame set this tile belongs to. See FrameIDFromTime().
+	Time      time.Time // Time of the scan. Same for every tile in the set.
+	Rows      int
+	Cols      int
+	Row       int     // 0 = southernmost row.
+	Col       int     // 0 = westernmost column.
+	OriginLat float64 // South-west corner of the mosaic.
+	OriginLng float64
+	TileSpan  float64 // Degrees covered by each tile, in both directions.
+	Data      []byte
+}
+
+type FrameSet struct {
+	FrameID   uint16
+	Time      time.Time
+	Rows      int
+	Cols      int
+	OriginLat float64
+	OriginLng float64
+	TileSpan  float64
+	Tiles     []Tile // Row-major, starting from the south-west corner.
+}
+
+// FrameIDFromTime returns the FrameID for a scan: its time in minutes, truncated to 16 bits. Stays
+// unique across broadcaster restarts, and refetching the same scan gives the same FrameID.
+func FrameIDFromTime(t time.Time) uint16 {
+	return uint16(t.Unix() / 60)
+}
+
+/*
+	BuildFrameSet().
+	 Fetches a mosaic of tiles covering 'rangeSM' statute miles around centerLat/centerLng.
+	 Either every tile is fetched from the same scan or an error is returned - a partial or mixed
+	 set is never returned, so a receiver never renders tiles from this scan next to tiles from
+	 another one.
+*/
+
+func BuildFrameSet(centerLat, centerLng float64, rangeSM uint, tileSpan float64, fetch TileFetcher) (*FrameSet, error) {
+	if tileSpan <= 0 {
+		return nil, errors.New("BuildFrameSet(): Invalid tile span.")
+	}
+
+	latRange := float64(rangeSM) / SM_PER_DEGREE
+	lngRange := latRange / math.Cos(centerLat*math.Pi/180.0)
+	rows := int(math.Ceil(2 * latRange / tileSpan))
+	cols := int(math.Ceil(2 * lngRange / tileSpan))
+	if rows < 1 {
+		rows = 1
+	}
+	if cols < 1 {
+		cols = 1
+	}
+	if rows > 255 || cols > 255 {
+		return nil, fmt.Errorf("BuildFrameSet(): Mosaic too large (%dx%d tiles).", rows, cols)
+	}
+
+	ret := &FrameSet{
+		Rows:      rows,
+		Cols:      cols,
+		OriginLat: centerLat - float64(rows)*tileSpan/2,
+		OriginLng: centerLng - float64(cols)*tileSpan/2,
+		TileSpan:  tileSpan,
+	}
+
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			lat := ret.OriginLat + (float64(row)+0.5)*tileSpan
+			lng := ret.OriginLng + (float64(col)+0.5)*tileSpan
+			data, scanTime, err := fetch(lat, lng)
+			if err != nil {
+				return nil, fmt.Errorf("BuildFrameSet(): Tile %d,%d: %s", row, col, err.Error())
+			}
+			if scanTime.IsZero() {
+				return nil, fmt.Errorf("BuildFrameSet(): Tile %d,%d has no scan time.", row, col)
+			}
+			if len(ret.Tiles) == 0 {
+				ret.Time = scanTime
+				ret.FrameID = FrameIDFromTime(scanTime)
+			} else if !scanTime.Equal(ret.Time) {
+				return nil, fmt.Errorf("BuildFrameSet(): Tile %d,%d is from the %s scan, expected %s.", row, col, scanTime, ret.Time)
+			}
+			ret.Tiles = append(ret.Tiles, Tile{
+				FrameID:   ret.FrameID,
+				Time:      ret.Time,
+				Rows:      rows,
+				Cols:      cols,
+				Row:       row,
+				Col:       col,
+				OriginLat: ret.OriginLat,
+				OriginLng: ret.OriginLng,
+				TileSpan:  tileSpan,
+				Data:      data,
+			})
+		}
+	}
+
+	return ret, nil
+}
+
+func (t Tile) Marshal() []byte {
+	ret := make([]byte, 0, TILE_HEADER_SIZE+len(t.Data))
+	ret = append(ret, TILE_VERSION)
+	ret = append(ret, byte(t.FrameID>>8), byte(t.FrameID))
+	tm := uint32(t.Time.Unix())
+	ret = append(ret, byte(tm>>24), byte(tm>>16), byte(tm>>8), byte(tm))
+	ret = append(ret, byte(t.Rows), byte(t.Cols), byte(t.Row), byte(t.Col))
+	lat := uint32(int32(math.Floor(t.OriginLat*POSITION_SCALE + 0.5)))
+	lng := uint32(int32(math.Floor(t.OriginLng*POSITION_SCALE + 0.5)))
+	ret = append(ret, byte(lat>>24), byte(lat>>16), byte(lat>>8), byte(lat))
+	ret = append(ret, byte(lng>>24), byte(lng>>16), byte(lng>>8), byte(lng))
+	span := uint16(math.Floor(t.TileSpan*SPAN_SCALE + 0.5))
+	ret = append(ret, byte(span>>8), byte(span))
+	return append(ret, t.Data...)
+}
+
+func UnmarshalTile(data []byte) (Tile, error) {
+	var ret Tile
+	if len(data) < TILE_HEADER_SIZE {
+		return ret, errors.New("UnmarshalTile(): Tile too short.")
+	}
+	if data[0] != TILE_VERSION {
+		return ret, fmt.Errorf("UnmarshalTile(): Unsupported tile version %d.", data[0])
+	}
+	ret.FrameID = uint16(data[1])<<8 | uint16(data[2])
+	ret.Time = time.Unix(int64(uint32(data[3])<<24|uint32(data[4])<<16|uint32(data[5])<<8|uint32(data[6])), 0)
+	ret.Rows, ret.Cols, ret.Row, ret.Col = int(data[7]), int(data[8]), int(data[9]), int(data[10])
+	if ret.Row >= ret.Rows || ret.Col >= ret.Cols {
+		return ret, fmt.Errorf("UnmarshalTile(): Tile %d,%d outside of %dx%d mosaic.", ret.Row, ret.Col, ret.Rows, ret.Cols)
+	}
+	lat := int32(uint32(data[11])<<24 | uint32(data[12])<<16 | uint32(data[13])<<8 | uint32(data[14]))
+	lng := int32(uint32(data[15])<<24 | uint32(data[16])<<16 | uint32(data[17])<<8 | uint32(data[18]))
+	ret.OriginLat = float64(lat) / POSITION_SCALE
+	ret.OriginLng = float64(lng) / POSITION_SCALE
+	ret.TileSpan = float64(uint16(data[19])<<8|uint16(data[20])) / SPAN_SCALE
+	ret.Data = data[TILE_HEADER_SIZE:]
+	return ret, nil
+}
+
+/*
+	FrameAssembler.
+	 Receiver side of BuildFrameSet(). Collects tiles and hands back a FrameSet only once every
+	 tile of the newest frame set has been received. Tiles from older frame sets are ignored.
+*/
+
+type FrameAssembler struct {
+	current  *FrameSet
+	have     map[int]bool // Row*Cols+Col -> received.
+	complete *FrameSet    // Last frame set handed back.
+	mu       *sync.Mutex
+}
+
+func NewFrameAssembler() *FrameAssembler {
+	a := new(FrameAssembler)
+	a.mu = &sync.Mutex{}
+	return a
+}
+
+// AddTile returns the complete frame set and true if 't' was the last missing tile.
+func (a *FrameAssembler) AddTile(t Tile) (*FrameSet, bool) {
+	if t.Rows < 1 || t.Cols < 1 || t.Row < 0 || t.Row >= t.Rows || t.Col < 0 || t.Col >= t.Cols {
+		return nil, false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.complete != nil && (t.FrameID == a.complete.FrameID || t.Time.Before(a.complete.Time)) {
+		return nil, false // Already delivered, or older than what was delivered.
+	}
+	if a.current != nil && t.FrameID != a.current.FrameID {
+		if t.Time.Before(a.current.Time) {
+			return nil, false // Stale tile from an older scan.
+		}
+		a.current = nil
+	}
+	if a.current == nil {
+		// Start collecting a new frame set.
+		a.current = &FrameSet{
+			FrameID:   t.FrameID,
+			Time:      t.Time,
+			Rows:      t.Rows,
+			Cols:      t.Cols,
+			OriginLat: t.OriginLat,
+			OriginLng: t.OriginLng,
+			TileSpan:  t.TileSpan,
+			Tiles:     make([]Tile, t.Rows*t.Cols),
+		}
+		a.have = make(map[int]bool, 0)
+	}
+
+	if t.Rows != a.current.Rows || t.Cols != a.current.Cols {
+		return nil, false
+	}
+	i := t.Row*a.current.Cols + t.Col
+	if a.have[i] {
+		return nil, false
+	}
+	a.current.Tiles[i] = t
+	a.have[i] = true
+
+	if len(a.have) < len(a.current.Tiles) {
+		return nil, false
+	}
+	a.complete = a.current
+	a.current = nil
+	return a.complete, true
+}
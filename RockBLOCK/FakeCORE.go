@@ -0,0 +1,230 @@
+package RockBLOCK
+
+import (
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FakeMT is an MT message accepted by a FakeCORE.
+type FakeMT struct {
+	IMEI      string
+	Data      []byte
+	MessageID string
+	Time      time.Time
+}
+
+type fakeDevice struct {
+	lineRental bool
+	momsn      int
+}
+
+/*
+	FakeCORE.
+	 Stand-in for the RockBLOCK web services, to test without an account or a device. It accepts
+	 MT posts (serve it and set Config.COREURL to its URL) and answers them the way RockBLOCK does,
+	 including the FAILED error codes. SendMO() posts MO messages to a webhook, like RockBLOCK
+	 delivering a message from a device.
+*/
+
+type FakeCORE struct {
+	Username   string
+	Password   string
+	WebhookURL string          // Where SendMO() posts, e.g. "http://localhost:8080/receiveRockBLOCK".
+	JWTKey     *rsa.PrivateKey // Signs MO posts if set.
+	devices    map[string]*fakeDevice
+	credits    int // -1 = unlimited.
+	failures   []int
+	sent       []FakeMT
+	nextID     int
+	mu         *sync.Mutex
+}
+
+func NewFakeCORE(username, password string) *FakeCORE {
+	f := new(FakeCORE)
+	f.Username = username
+	f.Password = password
+	f.devices = make(map[string]*fakeDevice, 0)
+	f.credits = -1
+	f.nextID = 1
+	f.mu = &sync.Mutex{}
+	return f
+}
+
+// AddDevice adds a device with line rental to the account.
+func (f *FakeCORE) AddDevice(imei string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.devices[imei] = &fakeDevice{lineRental: true}
+}
+
+// SetMOMSN sets the MOMSN SendMO() uses next for a device added with AddDevice().
+func (f *FakeCORE) SetMOMSN(imei string, momsn int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d, ok := f.devices[imei]; ok {
+		d.momsn = momsn & 0xFFFF
+	}
+}
+
+// SetLineRental turns line rental on or off for a device added with AddDevice().
+func (f *FakeCORE) SetLineRental(imei string, lineRental bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d, ok := f.devices[imei]; ok {
+		d.lineRental = lineRental
+	}
+}
+
+// SetCredits sets the account credit. Each MT message uses MessageCredits(). -1 = unlimited.
+func (f *FakeCORE) SetCredits(credits int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.credits = credits
+}
+
+func (f *FakeCORE) Credits() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.credits
+}
+
+// FailNext makes the next MT post fail with 'code' (CORE_ERR_*), whatever it contains. Calls queue up.
+func (f *FakeCORE) FailNext(code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, code)
+}
+
+// Sent returns the MT messages accepted so far.
+func (f *FakeCORE) Sent() []FakeMT {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := make([]FakeMT, len(f.sent))
+	copy(ret, f.sent)
+	return ret
+}
+
+// acceptMT checks an MT post. Returns the message ID, or the error code.
+func (f *FakeCORE) acceptMT(form url.Values) (string, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.failures) > 0 {
+		code := f.failures[0]
+		f.failures = f.failures[1:]
+		return "", code
+	}
+	if form.Get("username") != f.Username || form.Get("password") != f.Password {
+		return "", CORE_ERR_CREDENTIALS
+	}
+	imei := form.Get("imei")
+	d, ok := f.devices[imei]
+	if !ok {
+		return "", CORE_ERR_NO_DEVICE
+	}
+	if !d.lineRental {
+		return "", CORE_ERR_NO_LINE
+	}
+	if len(form.Get("data")) == 0 {
+		return "", CORE_ERR_NO_DATA
+	}
+	data, err := hex.DecodeString(form.Get("data"))
+	if err != nil {
+		return "", CORE_ERR_HEX
+	}
+	if len(data) > MAX_MT_SZ {
+		return "", CORE_ERR_TOO_LONG
+	}
+	credits := MessageCredits(len(data))
+	if f.credits >= 0 {
+		if f.credits < credits {
+			return "", CORE_ERR_NO_CREDIT
+		}
+		f.credits -= credits
+	}
+
+	id := strconv.Itoa(f.nextID)
+	f.nextID++
+	f.sent = append(f.sent, FakeMT{IMEI: imei, Data: data, MessageID: id, Time: time.Now()})
+	return id, 0
+}
+
+// ServeHTTP answers MT posts, on any path.
+func (f *FakeCORE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	id, code := f.acceptMT(r.PostForm)
+	if code != 0 {
+		fmt.Fprintf(w, "FAILED,%d,%s", code, coreErrors[code].Description)
+		return
+	}
+	fmt.Fprintf(w, "OK,%s", id)
+}
+
+/*
+	SendMO().
+	 Posts 'data' to WebhookURL as an MO message from 'imei', with the next MOMSN for the device
+	 and 'lat', 'lng' as the Iridium position. Returns the MOMSN used and the HTTP status of the
+	 webhook's answer.
+*/
+
+func (f *FakeCORE) SendMO(imei string, data []byte, lat, lng float64) (int, int, error) {
+	f.mu.Lock()
+	d, ok := f.devices[imei]
+	if !ok {
+		f.mu.Unlock()
+		return 0, 0, fmt.Errorf("SendMO(): Unknown device %s.", imei)
+	}
+	momsn := d.momsn
+	d.momsn = (d.momsn + 1) & 0xFFFF
+	webhook, key := f.WebhookURL, f.JWTKey
+	f.mu.Unlock()
+	if len(webhook) == 0 {
+		return momsn, 0, errors.New("SendMO(): No WebhookURL.")
+	}
+
+	fields := map[string]string{
+		"imei":              imei,
+		"momsn":             strconv.Itoa(momsn),
+		"transmit_time":     time.Now().UTC().Format(TRANSMIT_TIME_FORMAT),
+		"iridium_latitude":  strconv.FormatFloat(lat, 'f', 4, 64),
+		"iridium_longitude": strconv.FormatFloat(lng, 'f', 4, 64),
+		"iridium_cep":       "3",
+		"data":              hex.EncodeToString(data),
+	}
+	vals := url.Values{}
+	claims := make(map[string]interface{}, 0)
+	for k, v := range fields {
+		vals.Set(k, v)
+		claims[k] = v
+	}
+	if key != nil {
+		token, err := SignJWT(claims, key)
+		if err != nil {
+			return momsn, 0, err
+		}
+		vals.Set("JWT", token)
+	}
+
+	resp, err := http.PostForm(webhook, vals)
+	if err != nil {
+		return momsn, 0, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return momsn, resp.StatusCode, nil
+}
@@ -0,0 +1,273 @@
+package RockBLOCK
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// +SBDIX MO status codes, Iridium ISU AT Command Reference. +SBDI only reports 1 (success) or 2 (failure).
+const (
+	SBDIX_MO_OK            = 0
+	SBDIX_MO_GSS_TIMEOUT   = 10 // GSS reported that the call did not complete in the allowed time.
+	SBDIX_MO_RF_DROP       = 13 // RF link loss during the session.
+	SBDIX_MO_NO_NETWORK    = 32 // No network service.
+	SBDIX_MO_ANTENNA_FAULT = 33
+	SBDIX_MO_RADIO_BUSY    = 34
+	SBDIX_MO_BLOCKED       = 35 // ISU is attempting to register, busy.
+)
+
+/*
+	Modem9602.
+	 Emulates an Iridium 9602 on the serial side, for running RockBLOCKSerialConnection without
+	 a device. Supports AT, AT&K0, AT+SBDWT, AT+SBDWB, AT+SBDI, AT+SBDIX, AT+SBDRB, AT+CSQ,
+	 AT-MSSTM and AT+SBDD0, with echo on as the modem powers up. Set the signal quality, queue
+	 MT messages and make sessions fail to script a test.
+*/
+
+type Modem9602 struct {
+	Time          time.Time // Reported by AT-MSSTM. Zero = now.
+	signalQuality int
+	failSessions  int
+	failStatus    int
+	moBuffer      []byte
+	momsn         int
+	mtmsn         int
+	mtQueue       [][]byte
+	mtBuffer      []byte
+	sent          [][]byte
+	commands      []string
+	mu            *sync.Mutex
+}
+
+func NewModem9602() *Modem9602 {
+	m := new(Modem9602)
+	m.signalQuality = 5
+	m.mu = &sync.Mutex{}
+	return m
+}
+
+/*
+	NewModem9602Pipe().
+	 Returns a Modem9602 serving one end of an in-memory pipe, and the other end for
+	 NewRockBLOCKTransport(). The modem stops when the returned end is closed.
+*/
+
+func NewModem9602Pipe() (*Modem9602, io.ReadWriteCloser) {
+	m := NewModem9602()
+	a, b := net.Pipe()
+	go func() {
+		m.Serve(b)
+		b.Close()
+	}()
+	return m, a
+}
+
+// SetSignalQuality sets the AT+CSQ answer, 0-5. SBD sessions fail with SBDIX_MO_NO_NETWORK at 0.
+func (m *Modem9602) SetSignalQuality(q int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signalQuality = q
+}
+
+// FailSessions makes the next 'n' SBD sessions fail, reporting 'status' (SBDIX_MO_*) to AT+SBDIX.
+func (m *Modem9602) FailSessions(n, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failSessions = n
+	m.failStatus = status
+}
+
+// QueueMT queues a message at the "gateway", to be delivered by the next successful SBD session.
+func (m *Modem9602) QueueMT(data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mtQueue = append(m.mtQueue, data)
+}
+
+// Sent returns the MO messages sent by successful SBD sessions.
+func (m *Modem9602) Sent() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([][]byte, len(m.sent))
+	copy(ret, m.sent)
+	return ret
+}
+
+// Commands returns the AT commands received, without the "\r".
+func (m *Modem9602) Commands() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]string, len(m.commands))
+	copy(ret, m.commands)
+	return ret
+}
+
+// Serve answers commands on 'conn' until it fails or is closed. Returns nil at EOF.
+func (m *Modem9602) Serve(conn io.ReadWriter) error {
+	rd := bufio.NewReader(conn)
+	for {
+		line, err := rd.ReadBytes('\r')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Echo.
+		if _, err := conn.Write(line); err != nil {
+			return err
+		}
+		cmd := strings.TrimSpace(string(line))
+		if len(cmd) == 0 {
+			continue
+		}
+		m.mu.Lock()
+		m.commands = append(m.commands, cmd)
+		m.mu.Unlock()
+
+		resp, err := m.command(cmd, rd, conn)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func modemResponse(lines ...string) []byte {
+	ret := ""
+	for _, l := range lines {
+		ret += "\r\n" + l + "\r\n"
+	}
+	return []byte(ret)
+}
+
+// command answers one command. AT+SBDWB reads its data from 'rd' and says READY on 'w'.
+func (m *Modem9602) command(cmd string, rd *bufio.Reader, w io.Writer) ([]byte, error) {
+	upper := strings.ToUpper(cmd)
+	switch {
+	case upper == "AT", upper == "AT&K0":
+		return modemResponse("OK"), nil
+	case strings.HasPrefix(upper, "AT+SBDWT="):
+		text := cmd[len("AT+SBDWT="):]
+		if len(text) > 120 {
+			return modemResponse("ERROR"), nil
+		}
+		m.mu.Lock()
+		m.moBuffer = []byte(text)
+		m.mu.Unlock()
+		return modemResponse("OK"), nil
+	case strings.HasPrefix(upper, "AT+SBDWB="):
+		return m.writeBinary(cmd[len("AT+SBDWB="):], rd, w)
+	case upper == "AT+SBDIX":
+		return m.session(true), nil
+	case upper == "AT+SBDI":
+		return m.session(false), nil
+	case upper == "AT+SBDRB":
+		m.mu.Lock()
+		data := m.mtBuffer
+		m.mu.Unlock()
+		ret := []byte{byte(len(data) >> 8), byte(len(data))}
+		ret = append(ret, data...)
+		ret = append(ret, modemChecksum(data)...)
+		return append(ret, []byte("\r\nOK\r\n")...), nil
+	case upper == "AT+CSQ":
+		m.mu.Lock()
+		q := m.signalQuality
+		m.mu.Unlock()
+		return modemResponse(fmt.Sprintf("+CSQ:%d", q), "OK"), nil
+	case upper == "AT-MSSTM":
+		t := m.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		ticks := t.Sub(time.Date(2014, 5, 11, 14, 23, 55, 0, time.UTC)) / (90 * time.Millisecond)
+		return modemResponse(fmt.Sprintf("-MSSTM: %08x", uint32(ticks)), "OK"), nil
+	case upper == "AT+SBDD0":
+		m.mu.Lock()
+		m.moBuffer = nil
+		m.mu.Unlock()
+		return modemResponse("0", "OK"), nil
+	}
+	return modemResponse("ERROR"), nil
+}
+
+func modemChecksum(data []byte) []byte {
+	var sum int
+	for _, c := range data {
+		sum += int(c)
+	}
+	return []byte{byte(sum >> 8), byte(sum)}
+}
+
+/*
+	writeBinary().
+	 AT+SBDWB=<length>: answers READY, reads <length> bytes plus the two byte checksum and answers
+	 0 (ok), 2 (bad checksum) or 3 (bad length, without READY).
+*/
+
+func (m *Modem9602) writeBinary(arg string, rd *bufio.Reader, w io.Writer) ([]byte, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > MAX_MO_SZ {
+		return modemResponse("3", "OK"), nil
+	}
+	if _, err := w.Write(modemResponse("READY")); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		return nil, err
+	}
+	data, sum := buf[:n], buf[n:]
+	if c := modemChecksum(data); c[0] != sum[0] || c[1] != sum[1] {
+		return modemResponse("2", "OK"), nil
+	}
+	m.mu.Lock()
+	m.moBuffer = data
+	m.mu.Unlock()
+	return modemResponse("0", "OK"), nil
+}
+
+// session runs an SBD session and returns the +SBDIX (or +SBDI) answer.
+func (m *Modem9602) session(extended bool) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	moStatus, mtStatus, mtLen := SBDIX_MO_OK, 0, 0
+	if m.signalQuality == 0 {
+		moStatus, mtStatus = SBDIX_MO_NO_NETWORK, 2
+	} else if m.failSessions > 0 {
+		m.failSessions--
+		moStatus, mtStatus = m.failStatus, 2
+	} else {
+		if len(m.moBuffer) > 0 {
+			m.sent = append(m.sent, m.moBuffer)
+			m.momsn = (m.momsn + 1) & 0xFFFF
+		}
+		if len(m.mtQueue) > 0 {
+			m.mtBuffer = m.mtQueue[0]
+			m.mtQueue = m.mtQueue[1:]
+			m.mtmsn = (m.mtmsn + 1) & 0xFFFF
+			mtStatus, mtLen = 1, len(m.mtBuffer)
+		}
+	}
+
+	if extended {
+		return modemResponse(fmt.Sprintf("+SBDIX: %d, %d, %d, %d, %d, %d", moStatus, m.momsn, mtStatus, m.mtmsn, mtLen, len(m.mtQueue)), "OK")
+	}
+	// +SBDI: 0 = no MO message to send, 1 = sent, 2 = failed.
+	sbdiStatus := 1
+	if moStatus != SBDIX_MO_OK {
+		sbdiStatus = 2
+	} else if len(m.moBuffer) == 0 {
+		sbdiStatus = 0
+	}
+	return modemResponse(fmt.Sprintf("+SBDI: %d, %d, %d, %d, %d, %d", sbdiStatus, m.momsn, mtStatus, m.mtmsn, mtLen, len(m.mtQueue)), "OK")
+}
@@ -1,16 +1,27 @@
 package RockBLOCK
 
+import (
+	"time"
+)
+
 const (
 	MAX_MO_SZ = 340 // p.7 Iridium-9602-SBD-Transceiver-Product-Developers-Guide.pdf.
 	MAX_MT_SZ = 270 // p.7 Iridium-9602-SBD-Transceiver-Product-Developers-Guide.pdf.
+	CREDIT_SZ = 50  // Bytes per credit, RockBLOCK-Web-Services-User-Guide.pdf.
 )
 
+// MessageCredits is the number of credits a message of 'n' bytes costs.
+func MessageCredits(n int) int {
+	return (n + CREDIT_SZ - 1) / CREDIT_SZ
+}
+
 // After decoding the 50 bytes.
 type IridiumMessage struct {
 	LatLngPresent bool
 	Lat           float64
 	Lng           float64
-	RequestType   int
+	RequestType   int       // REQUEST_*.
+	Time          time.Time // Time the message was composed. Zero if not present.
 	Data          []byte
 }
 
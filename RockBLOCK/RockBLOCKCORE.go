@@ -3,16 +3,26 @@ package RockBLOCK
 import (
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/ajg/form"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	REQUEST_NIL   = iota // No response required, just a status update.
-	REQUEST_METAR        // Request a METAR response. Data is a field identifier.
+	REQUEST_NIL             = iota // No response required, just a status update.
+	REQUEST_METAR                  // Request a METAR response. Data is a field identifier.
+	REQUEST_TAF                    // Request a TAF response. Data is a field identifier.
+	REQUEST_PIREP                  // Request PIREPs near the sender. Data is empty.
+	REQUEST_WINDS_ALOFT            // Request the winds aloft forecast. Data is a reporting station identifier.
+	REQUEST_AIRPORTS               // Request the airports nearest to the sender. Data is empty.
+	REQUEST_PING                   // Request an empty reply, to check the link.
+	REQUEST_NEAREST_WEATHER        // Request packed METARs from the stations nearest to the sender. Data is empty or the number of stations (1 byte).
+	REQUEST_ROUTE_WEATHER          // Request flight categories along a route. Data is the corridor width (1 byte, statute miles) then the route, e.g. "KDTW;KRMY".
+	requestTypeCount
 )
 
 type RockBLOCKTime struct {
@@ -46,49 +56,145 @@ type RockBLOCKCOREOutgoing struct {
 	Data     []byte `form:"data"`
 }
 
-func (m *RockBLOCKCOREIncoming) Process() IridiumMessage {
-	//TODO.
+/*
+	Process().
+	 Decodes the (already hex-decoded) Data into an IridiumMessage. Binary messages start with
+	 UPLINK_VERSION, anything else is handled as one of the legacy text messages.
+*/
+
+func (m *RockBLOCKCOREIncoming) Process() (IridiumMessage, error) {
 	var ret IridiumMessage
-	return ret
+	var err error
+	if len(m.Data) > 0 && m.Data[0] == UPLINK_VERSION {
+		ret, err = UnmarshalIridiumMessage([]byte(m.Data))
+	} else {
+		ret, err = processLegacy(m.Data)
+	}
+	if err != nil {
+		return ret, fmt.Errorf("Process(): MOMSN %s: %s", m.MOMSN, err.Error())
+	}
+	return ret, nil
+}
+
+// RockBLOCK MT endpoint error codes, RockBLOCK-Web-Services-User-Guide.pdf.
+const (
+	CORE_ERR_CREDENTIALS = 10 // Invalid login credentials.
+	CORE_ERR_NO_DEVICE   = 11 // No RockBLOCK with this IMEI found on the account.
+	CORE_ERR_NO_LINE     = 12 // RockBLOCK has no line rental.
+	CORE_ERR_NO_CREDIT   = 13 // Account has insufficient credit.
+	CORE_ERR_HEX         = 14 // Could not decode hex data.
+	CORE_ERR_TOO_LONG    = 15 // Data too long.
+	CORE_ERR_NO_DATA     = 16 // No data.
+	CORE_ERR_SYSTEM      = 99 // System error.
+)
+
+// COREError is a FAILED response from the RockBLOCK MT endpoint, e.g. "FAILED,15,Data too long".
+type COREError struct {
+	Code        int
+	Description string
+}
+
+func (e COREError) Error() string {
+	return fmt.Sprintf("RockBLOCK error %d: %s", e.Code, e.Description)
+}
+
+// Permanent is true if the message itself was refused - sending it again won't help. Account
+// problems (credentials, line rental, credit) can be fixed, so they are not permanent.
+func (e COREError) Permanent() bool {
+	return e.Code == CORE_ERR_HEX || e.Code == CORE_ERR_TOO_LONG || e.Code == CORE_ERR_NO_DATA
+}
+
+// Documented errors. Send() returns these (compare with ==) for the known codes.
+var (
+	ErrCORECredentials = COREError{CORE_ERR_CREDENTIALS, "Invalid login credentials"}
+	ErrCORENoDevice    = COREError{CORE_ERR_NO_DEVICE, "No RockBLOCK with this IMEI found on your account"}
+	ErrCORENoLine      = COREError{CORE_ERR_NO_LINE, "RockBLOCK has no line rental"}
+	ErrCORENoCredit    = COREError{CORE_ERR_NO_CREDIT, "Your account has insufficient credit"}
+	ErrCOREHex         = COREError{CORE_ERR_HEX, "Could not decode hex data"}
+	ErrCORETooLong     = COREError{CORE_ERR_TOO_LONG, "Data too long"}
+	ErrCORENoData      = COREError{CORE_ERR_NO_DATA, "No data"}
+	ErrCORESystem      = COREError{CORE_ERR_SYSTEM, "System Error"}
+)
+
+var coreErrors = map[int]COREError{
+	CORE_ERR_CREDENTIALS: ErrCORECredentials,
+	CORE_ERR_NO_DEVICE:   ErrCORENoDevice,
+	CORE_ERR_NO_LINE:     ErrCORENoLine,
+	CORE_ERR_NO_CREDIT:   ErrCORENoCredit,
+	CORE_ERR_HEX:         ErrCOREHex,
+	CORE_ERR_TOO_LONG:    ErrCORETooLong,
+	CORE_ERR_NO_DATA:     ErrCORENoData,
+	CORE_ERR_SYSTEM:      ErrCORESystem,
+}
+
+// parseCOREResponse reads an MT endpoint response, "OK,{message id}" or "FAILED,{code},{description}".
+func parseCOREResponse(body string) (string, error) {
+	x := strings.SplitN(strings.TrimSpace(body), ",", 3)
+	if x[0] == "OK" && len(x) == 2 {
+		// Success.
+		return x[1], nil
+	}
+
+	// Is there a valid error response?
+	if x[0] == "FAILED" && len(x) == 3 {
+		code, err := strconv.Atoi(x[1])
+		if err == nil {
+			if e, ok := coreErrors[code]; ok {
+				return "", e
+			}
+			return "", COREError{Code: code, Description: x[2]}
+		}
+	}
+
+	// Not even a valid error response.
+	return "", errors.New("Invalid response.")
+}
+
+// Credits is what sending the message costs.
+func (m *RockBLOCKCOREOutgoing) Credits() int {
+	return MessageCredits(len(m.Data))
 }
 
+/*
+	Send().
+	 Posts the message to the RockBLOCK MT endpoint. Returns the message ID assigned by RockBLOCK.
+	 A FAILED response is returned as a COREError, anything else (network, HTTP status) as a plain error.
+*/
+
 func (m *RockBLOCKCOREOutgoing) Send() (string, error) {
-	m.Username = CORE_USER
-	m.Password = CORE_PASS
+	c := GetConfig()
+	if len(c.COREUser) == 0 || len(c.COREPass) == 0 {
+		return "", errors.New("No RockBLOCK credentials configured.")
+	}
 
 	if len(m.IMEI) == 0 || len(m.Data) == 0 {
 		return "", errors.New("Insufficient data.")
 	}
 
-	// Hex-encode the 'Data' value.
-	encodedData := make([]byte, hex.EncodedLen(len(m.Data)))
-	hex.Encode(encodedData, m.Data)
-	m.Data = encodedData
+	// Hex-encode the 'Data' value. 'm' is left as it is so that it can be sent again.
+	out := *m
+	out.Username = c.COREUser
+	out.Password = c.COREPass
+	out.Data = make([]byte, hex.EncodedLen(len(m.Data)))
+	hex.Encode(out.Data, m.Data)
 
-	vals, err := form.EncodeToValues(m)
+	vals, err := form.EncodeToValues(out)
 	if err != nil {
 		return "", err
 	}
 
 	// Get the response.
-	resp, err := http.PostForm("https://core.rock7.com/rockblock/MT", vals)
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	resp, err := http.PostForm(c.MTURL(), vals)
 	if err != nil {
 		return "", err
 	}
-
-	x := strings.Split(string(body), ",")
-	if x[0] == "OK" {
-		// Success.
-		return x[1], nil
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Send(): HTTP status %s.", resp.Status)
 	}
-
-	// Is there a valid error response?
-	if len(x) > 2 {
-		return "", errors.New(strings.Join(x[1:], ","))
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
 	}
-
-	// Not even a valid error response.
-	return "", errors.New("Invalid response.")
+	return parseCOREResponse(string(body))
 }
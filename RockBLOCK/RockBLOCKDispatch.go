@@ -0,0 +1,100 @@
+package RockBLOCK
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RequestHandler answers one decoded request. A nil reply means nothing is sent back.
+type RequestHandler func(in *RockBLOCKCOREIncoming, req IridiumMessage) ([]byte, error)
+
+// MultiRequestHandler answers one decoded request with any number of MT messages.
+type MultiRequestHandler func(in *RockBLOCKCOREIncoming, req IridiumMessage) ([][]byte, error)
+
+// TemporaryError marks a handler failure that may go away if the request is retried, e.g. ADDS being unreachable.
+type TemporaryError struct {
+	Err error
+}
+
+func (e TemporaryError) Error() string {
+	return e.Err.Error()
+}
+
+func IsTemporary(err error) bool {
+	_, ok := err.(TemporaryError)
+	return ok
+}
+
+/*
+	Dispatcher.
+	 Routes decoded requests to the RequestHandler registered for their RequestType, and wraps
+	 the reply in a RockBLOCKCOREOutgoing addressed to the device that sent the request.
+*/
+
+type Dispatcher struct {
+	handlers map[int]MultiRequestHandler
+	mu       *sync.Mutex
+}
+
+func NewDispatcher() *Dispatcher {
+	d := new(Dispatcher)
+	d.handlers = make(map[int]MultiRequestHandler, 0)
+	d.mu = &sync.Mutex{}
+	return d
+}
+
+// Register sets the handler for 'requestType', replacing any existing one.
+func (d *Dispatcher) Register(requestType int, h RequestHandler) {
+	d.RegisterMulti(requestType, func(in *RockBLOCKCOREIncoming, req IridiumMessage) ([][]byte, error) {
+		reply, err := h(in, req)
+		if err != nil || len(reply) == 0 {
+			return nil, err
+		}
+		return [][]byte{reply}, nil
+	})
+}
+
+func (d *Dispatcher) RegisterMulti(requestType int, h MultiRequestHandler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handlers[requestType] = h
+}
+
+/*
+	Dispatch().
+	 Calls the handler for req.RequestType. Returns no messages if the handler has no reply.
+	 Replies longer than MAX_MT_SZ are refused rather than truncated.
+*/
+
+func (d *Dispatcher) Dispatch(in *RockBLOCKCOREIncoming, req IridiumMessage) ([]*RockBLOCKCOREOutgoing, error) {
+	d.mu.Lock()
+	h, ok := d.handlers[req.RequestType]
+	d.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Dispatch(): No handler for request type %d.", req.RequestType)
+	}
+
+	replies, err := h(in, req)
+	if err != nil {
+		ret := fmt.Errorf("Dispatch(): Request type %d: %s", req.RequestType, err.Error())
+		if IsTemporary(err) {
+			return nil, TemporaryError{Err: ret}
+		}
+		return nil, ret
+	}
+
+	ret := make([]*RockBLOCKCOREOutgoing, 0)
+	for i, reply := range replies {
+		if len(reply) == 0 {
+			continue
+		}
+		if len(reply) > MAX_MT_SZ {
+			return nil, fmt.Errorf("Dispatch(): Request type %d: Reply %d too long (%d bytes, max %d).", req.RequestType, i, len(reply), MAX_MT_SZ)
+		}
+		m := new(RockBLOCKCOREOutgoing)
+		m.IMEI = in.IMEI
+		m.Data = reply
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
@@ -0,0 +1,174 @@
+package RockBLOCK
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	TRANSMIT_TIME_FORMAT = "06-01-02 15:04:05" // transmit_time as posted by RockBLOCK, UTC.
+	// Oldest transmit_time accepted by VerifyFormJWT(). RockBLOCK retries a failed delivery 14 times, waiting 1 minute
+	// and doubling the wait each time - 16383 minutes (11.4 days) in all. Replays within this are caught by the MOMSN.
+	JWT_MAX_AGE  = 12 * 24 * time.Hour
+	JWT_MAX_SKEW = 5 * time.Minute // Furthest in the future a transmit_time may be, for clock differences.
+)
+
+// Form fields that must be signed by the JWT that RockBLOCK sends with each delivered MO message.
+var jwtSignedFields = []string{"imei", "momsn", "transmit_time"}
+
+// ParsePublicKey reads the PEM encoded RockBLOCK public key.
+func ParsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("ParsePublicKey(): No PEM data.")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("ParsePublicKey(): %s", err.Error())
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("ParsePublicKey(): Not an RSA public key.")
+	}
+	return rsaKey, nil
+}
+
+// ParsePrivateKey reads a PEM encoded RSA private key (PKCS #1 or PKCS #8), for signing test messages.
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("ParsePrivateKey(): No PEM data.")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("ParsePrivateKey(): %s", err.Error())
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("ParsePrivateKey(): Not an RSA private key.")
+	}
+	return rsaKey, nil
+}
+
+// SignJWT makes an RS256 token for 'claims', as RockBLOCK does. Used by FakeCORE.
+func SignJWT(claims map[string]interface{}, key *rsa.PrivateKey) (string, error) {
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("SignJWT(): %s", err.Error())
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("SignJWT(): %s", err.Error())
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+/*
+	VerifyJWT().
+	 Checks the RS256 signature of 'token' with 'key' and returns its claims. Numbers in the claims
+	 are left as json.Number.
+*/
+
+func VerifyJWT(token string, key *rsa.PublicKey) (map[string]interface{}, error) {
+	x := strings.Split(token, ".")
+	if len(x) != 3 {
+		return nil, errors.New("VerifyJWT(): Malformed token.")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(x[0])
+	if err != nil {
+		return nil, errors.New("VerifyJWT(): Malformed header.")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("VerifyJWT(): Malformed header.")
+	}
+	// Only RS256 - never trust the token to choose how it is checked.
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("VerifyJWT(): Unsupported algorithm '%s'.", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(x[2])
+	if err != nil {
+		return nil, errors.New("VerifyJWT(): Malformed signature.")
+	}
+	hash := sha256.Sum256([]byte(x[0] + "." + x[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+		return nil, errors.New("VerifyJWT(): Invalid signature.")
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(x[1])
+	if err != nil {
+		return nil, errors.New("VerifyJWT(): Malformed claims.")
+	}
+	claims := make(map[string]interface{}, 0)
+	dec := json.NewDecoder(bytes.NewReader(claimsJSON))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return nil, errors.New("VerifyJWT(): Malformed claims.")
+	}
+	return claims, nil
+}
+
+/*
+	VerifyFormJWT().
+	 Verifies the token RockBLOCK posts in the "JWT" form field, and that every other posted field
+	 ('form', field name -> value as posted) was signed with the value posted. The signed
+	 transmit_time must be within JWT_MAX_AGE (JWT_MAX_SKEW ahead) of now, so that a captured post
+	 can't be replayed once its MOMSN has been forgotten.
+*/
+
+func VerifyFormJWT(form map[string]string, key *rsa.PublicKey) error {
+	token, ok := form["JWT"]
+	if !ok || len(token) == 0 {
+		return errors.New("VerifyFormJWT(): No JWT.")
+	}
+	claims, err := VerifyJWT(token, key)
+	if err != nil {
+		return err
+	}
+	for _, f := range jwtSignedFields {
+		if _, ok := form[f]; !ok {
+			return fmt.Errorf("VerifyFormJWT(): Field '%s' not posted.", f)
+		}
+	}
+	for f, v := range form {
+		if f == "JWT" {
+			continue
+		}
+		c, ok := claims[f]
+		if !ok {
+			return fmt.Errorf("VerifyFormJWT(): Field '%s' not signed.", f)
+		}
+		if fmt.Sprint(c) != v {
+			return fmt.Errorf("VerifyFormJWT(): Field '%s' does not match the signed value.", f)
+		}
+	}
+
+	t, err := time.Parse(TRANSMIT_TIME_FORMAT, form["transmit_time"])
+	if err != nil {
+		return fmt.Errorf("VerifyFormJWT(): Invalid transmit_time '%s'.", form["transmit_time"])
+	}
+	if age := time.Since(t); age > JWT_MAX_AGE || age < -JWT_MAX_SKEW {
+		return fmt.Errorf("VerifyFormJWT(): transmit_time %s is outside the accepted window.", form["transmit_time"])
+	}
+	return nil
+}
@@ -12,6 +12,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/tarm/serial"
+	"io"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,9 +28,45 @@ var downloadBinaryMessage = []byte("AT+SBDRB")
 var requestSystemTimeMessage = []byte("AT-MSSTM")
 var clearBuffers = []byte("AT+SBDD0")
 
+const (
+	SERIAL_DEFAULT_DEVICE          = "/dev/ttyUSB0"
+	SERIAL_DEFAULT_BAUD            = 19200
+	SERIAL_DEFAULT_COMMAND_TIMEOUT = 5 * time.Minute // SBD sessions can take a while.
+	SERIAL_DEFAULT_NETWORK_POLL    = 5 * time.Second
+	PERSISTENT_RETRY_BASE          = 1 * time.Second // Wait after a failed SendBinaryPersistent() attempt, doubled for each retry after that.
+	PERSISTENT_RETRY_MAX           = 5 * time.Minute
+)
+
+// SerialOptions configures a RockBLOCKSerialConnection. Zero values are replaced by the SERIAL_DEFAULT_* values.
+type SerialOptions struct {
+	Device         string        // Serial device, only used by NewRockBLOCKSerialWithOptions().
+	Baud           int           // Only used by NewRockBLOCKSerialWithOptions().
+	ReadTimeout    time.Duration // Serial port read timeout, only used by NewRockBLOCKSerialWithOptions(). 0 = reads block.
+	CommandTimeout time.Duration // How long to wait for the modem to answer a command.
+	NetworkPoll    time.Duration // How often WaitForNetwork() checks the signal quality.
+}
+
+func (o SerialOptions) withDefaults() SerialOptions {
+	if len(o.Device) == 0 {
+		o.Device = SERIAL_DEFAULT_DEVICE
+	}
+	if o.Baud == 0 {
+		o.Baud = SERIAL_DEFAULT_BAUD
+	}
+	if o.CommandTimeout == 0 {
+		o.CommandTimeout = SERIAL_DEFAULT_COMMAND_TIMEOUT
+	}
+	if o.NetworkPoll == 0 {
+		o.NetworkPoll = SERIAL_DEFAULT_NETWORK_POLL
+	}
+	return o
+}
+
 type RockBLOCKSerialConnection struct {
-	SerialConfig      *serial.Config
-	SerialPort        *serial.Port
+	SerialConfig      *serial.Config     // nil unless opened by NewRockBLOCKSerialWithOptions().
+	SerialPort        *serial.Port       // nil unless opened by NewRockBLOCKSerialWithOptions(). Same as Transport.
+	Transport         io.ReadWriteCloser // Serial port, pty, TCP serial bridge, pipe...
+	Options           SerialOptions
 	SerialIn          chan []byte
 	SerialOut         chan []byte
 	processedBuffer   [][]byte
@@ -41,6 +78,11 @@ type RockBLOCKSerialConnection struct {
 	MTMessages        [][]byte
 	msgHandler        RockBLOCKMTMessageHandler // Callback.
 	persistentMsgChan chan []byte
+	closed            chan bool
+	closeOnce         *sync.Once
+	sbdrbPending      bool // AT+SBDRB sent, its binary response follows the echo.
+	sbdrbFrame        bool // Next token is the AT+SBDRB binary response.
+	sbdrbMu           *sync.Mutex
 }
 
 type RockBLOCKCallbackInfo struct {
@@ -55,27 +97,92 @@ const (
 
 type RockBLOCKMTMessageHandler func(RockBLOCKCallbackInfo) error
 
-func NewRockBLOCKSerial() (r *RockBLOCKSerialConnection, err error) {
-	r = new(RockBLOCKSerialConnection)
+// NewRockBLOCKSerial opens SERIAL_DEFAULT_DEVICE at SERIAL_DEFAULT_BAUD.
+func NewRockBLOCKSerial() (*RockBLOCKSerialConnection, error) {
+	return NewRockBLOCKSerialWithOptions(SerialOptions{})
+}
+
+func NewRockBLOCKSerialWithOptions(opts SerialOptions) (*RockBLOCKSerialConnection, error) {
+	opts = opts.withDefaults()
 
 	// Open serial port.
-	cnf := &serial.Config{Name: "/dev/ttyUSB0", Baud: 19200}
-	p, errn := serial.OpenPort(cnf)
-	if errn != nil {
-		err = fmt.Errorf("serial port err: %s\n", errn.Error())
-		return
+	cnf := &serial.Config{Name: opts.Device, Baud: opts.Baud, ReadTimeout: opts.ReadTimeout}
+	p, err := serial.OpenPort(cnf)
+	if err != nil {
+		return nil, fmt.Errorf("serial port err: %s", err.Error())
 	}
 
 	// Serial port opened successfully.
-	r.SerialConfig = cnf
-	r.SerialPort = p
+	r, err := NewRockBLOCKTransport(p, opts)
+	if r != nil {
+		r.SerialConfig = cnf
+		r.SerialPort = p
+	}
+	return r, err
+}
+
+/*
+	NewRockBLOCKTransport().
+	 Runs the driver over 't', which must carry the modem's serial data as is. 'opts.Device' and
+	 'opts.Baud' are not used. The connection is returned along with any initialization error,
+	 so that it can be closed.
+*/
+
+func NewRockBLOCKTransport(t io.ReadWriteCloser, opts SerialOptions) (*RockBLOCKSerialConnection, error) {
+	r := new(RockBLOCKSerialConnection)
+	r.Transport = t
+	r.Options = opts.withDefaults()
 	// Create mutex.
 	r.mu = &sync.Mutex{}
+	r.sbdrbMu = &sync.Mutex{}
+	r.closed = make(chan bool)
+	r.closeOnce = &sync.Once{}
 
 	// Initialize the device. If there's an error, return it.
-	err = r.Init()
+	err := r.Init()
+
+	return r, err
+}
+
+// Close closes the transport. The connection can't be used after this.
+func (r *RockBLOCKSerialConnection) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		err = r.Transport.Close()
+	})
+	return err
+}
 
-	return
+/*
+	transportReader.
+	 Reads the transport for serialReader(). With a ReadTimeout, tarm/serial answers a read that
+	 times out with 0 bytes and io.EOF - the scanner would take that as the end of the data and
+	 stop, so those reads are retried until the connection is closed. Only for a serial port
+	 opened by NewRockBLOCKSerialWithOptions(), io.EOF from any other transport is the end.
+*/
+
+type transportReader struct {
+	r *RockBLOCKSerialConnection
+}
+
+func (t transportReader) Read(p []byte) (int, error) {
+	r := t.r
+	for {
+		n, err := r.Transport.Read(p)
+		if r.SerialPort == nil || r.Options.ReadTimeout == 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		// Timed out.
+		select {
+		case <-r.closed:
+			return 0, io.EOF
+		default:
+		}
+	}
 }
 
 func RockBLOCKScanSplit(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -94,6 +201,39 @@ func RockBLOCKScanSplit(data []byte, atEOF bool) (advance int, token []byte, err
 	return 0, nil, nil
 }
 
+/*
+	scanSplit().
+	 RockBLOCKScanSplit, except for the AT+SBDRB response: binary, not '\r' terminated and
+	 likely to contain '\r'. It is returned as one token - length (2 bytes), message, checksum
+	 (2 bytes).
+*/
+
+func (r *RockBLOCKSerialConnection) scanSplit(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	r.sbdrbMu.Lock()
+	defer r.sbdrbMu.Unlock()
+	if r.sbdrbFrame {
+		if len(data) >= 2 {
+			n := 2 + (int(data[0])<<8 | int(data[1])) + 2
+			if len(data) >= n {
+				r.sbdrbFrame = false
+				return n, data[:n], nil
+			}
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+
+	advance, token, err = RockBLOCKScanSplit(data, atEOF)
+	if r.sbdrbPending && token != nil && string(bytes.TrimPrefix(token, []byte("\n"))) == string(downloadBinaryMessage) {
+		// Echo of AT+SBDRB.
+		r.sbdrbPending = false
+		r.sbdrbFrame = true
+	}
+	return advance, token, err
+}
+
 /*
 	parseSBDI().
 	 Parses a status response like:
@@ -171,12 +311,14 @@ func (r *RockBLOCKSerialConnection) parseMSSTM(msg []byte) error {
 	return nil
 }
 
+// serialReader reads lines from the transport until it fails or the connection is closed.
 func (r *RockBLOCKSerialConnection) serialReader() {
-	scanner := bufio.NewScanner(r.SerialPort)
-	scanner.Split(RockBLOCKScanSplit)
+	scanner := bufio.NewScanner(transportReader{r})
+	scanner.Split(r.scanSplit)
 	for scanner.Scan() {
 		m := scanner.Bytes()
-		m = bytes.Trim(m, "\r\n")
+		// Only the '\n' left over from the previous "\r\n" - binary data (AT+SBDRB) can start or end with either.
+		m = bytes.TrimPrefix(m, []byte("\n"))
 		if len(m) > 0 {
 			// Automatic parsing.
 			//TODO Parse all relevant information automatically.
@@ -190,15 +332,31 @@ func (r *RockBLOCKSerialConnection) serialReader() {
 				r.parseMSSTM(m)
 			}
 
-			r.SerialIn <- bytes.Trim(m, "\r")
+			select {
+			case r.SerialIn <- append([]byte(nil), m...): // Copied, the scanner reuses its buffer.
+			case <-r.closed:
+				return
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		select {
+		case <-r.closed:
+		default:
+			fmt.Printf("serial read error: %s\n", err.Error())
 		}
 	}
 }
 
 func (r *RockBLOCKSerialConnection) serialWriter() {
 	for {
-		m := <-r.SerialOut
-		_, err := r.SerialPort.Write(m)
+		var m []byte
+		select {
+		case m = <-r.SerialOut:
+		case <-r.closed:
+			return
+		}
+		_, err := r.Transport.Write(m)
 		if err != nil {
 			fmt.Printf("serial write error: %s\n", err.Error())
 		}
@@ -207,7 +365,11 @@ func (r *RockBLOCKSerialConnection) serialWriter() {
 
 func (r *RockBLOCKSerialConnection) serialWrite(m []byte) {
 	fmt.Printf("sent: %s\n", string(m))
-	r.SerialOut <- m
+	select {
+	case r.SerialOut <- m:
+	case <-r.closed:
+		// serialWait() reports it.
+	}
 }
 
 type MsgEqualFunc func([]byte, []byte) bool
@@ -226,7 +388,7 @@ func StringSuffix(val, suffix []byte) bool {
 
 // For parsed commands, the return value comes after it has been parsed.
 func (r *RockBLOCKSerialConnection) serialWait(comp []byte, eq MsgEqualFunc) error {
-	timeoutTicker := time.NewTicker(5 * time.Minute)
+	timeout := time.After(r.Options.CommandTimeout)
 	for {
 		select {
 		case m := <-r.SerialIn:
@@ -235,8 +397,10 @@ func (r *RockBLOCKSerialConnection) serialWait(comp []byte, eq MsgEqualFunc) err
 			if eq(m, comp) {
 				return nil
 			}
-		case <-timeoutTicker.C:
+		case <-timeout:
 			return errors.New("serialWait(): Timeout.")
+		case <-r.closed:
+			return errors.New("serialWait(): Connection closed.")
 		}
 	}
 	return errors.New("serialWait(): Unknown error.")
@@ -260,6 +424,7 @@ func (r *RockBLOCKSerialConnection) Init() error {
 	// Set up the read/write channels.
 	r.SerialIn = make(chan []byte)
 	r.SerialOut = make(chan []byte)
+	r.persistentMsgChan = make(chan []byte, 1024)
 
 	// Start the read/write goroutines.
 	go r.serialReader()
@@ -335,7 +500,6 @@ func (r *RockBLOCKSerialConnection) binaryChecksum(msg []byte) []byte {
 	return []byte{byte((sum & 0xFF00) >> 8), byte(sum & 0xFF)}
 }
 
-//TESTME.
 func (r *RockBLOCKSerialConnection) SendBinary(msg []byte) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -396,6 +560,9 @@ func (r *RockBLOCKSerialConnection) getSignalQuality() (int, error) {
 	if err := r.serialWaitPrefix([]byte("+CSQ:")); err != nil {
 		return -1, err
 	}
+	if err := r.serialWaitEqual("OK"); err != nil {
+		return -1, err
+	}
 
 	return r.SignalQuality, nil
 
@@ -404,14 +571,14 @@ func (r *RockBLOCKSerialConnection) getSignalQuality() (int, error) {
 /*
 	WaitForNetwork().
 	 Returns nil if and only if a signal quality indicator greater than 0 is encountered in less than 't'.
-	 Checks once per 5 seconds.
+	 Checks once per Options.NetworkPoll.
 */
 func (r *RockBLOCKSerialConnection) WaitForNetwork(t time.Duration) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	finishTicker := time.NewTicker(t)
-	checkTicker := time.NewTicker(5 * time.Second)
+	checkTicker := time.NewTicker(r.Options.NetworkPoll)
 	for {
 		select {
 		case <-finishTicker.C:
@@ -452,10 +619,13 @@ func (r *RockBLOCKSerialConnection) downloadMessage() error {
 	}
 
 	// Initiate the download.
+	r.sbdrbMu.Lock()
+	r.sbdrbPending = true
+	r.sbdrbMu.Unlock()
 	msg := append(downloadBinaryMessage, byte('\r'))
 	r.serialWrite(msg)
 
-	err := r.serialWaitSuffix([]byte("OK")) // Device sends "OK" after the transfer.
+	err := r.serialWaitEqual("OK") // Device sends "OK" after the transfer.
 	if err != nil {
 		return err
 	}
@@ -476,7 +646,7 @@ func (r *RockBLOCKSerialConnection) downloadMessage() error {
 
 	myBuf = myBuf[:len(myBuf)-1] // Remove the last message - "OK".
 
-	// Re-join on '\r'.
+	// scanSplit() returns the response in one piece, but re-join on '\r' anyway.
 	binaryMsg := bytes.Join(myBuf, []byte("\r"))
 
 	// Get to work on binaryMsg.
@@ -499,7 +669,7 @@ func (r *RockBLOCKSerialConnection) downloadMessage() error {
 	myChecksum := r.binaryChecksum(finalMsg)
 
 	if msgChecksum[0] != myChecksum[0] || msgChecksum[1] != myChecksum[1] {
-		return fmt.Errorf("downloadMessage(): Bad checksum: msgChecksum=%02x%02x, myChecksum=%02x02x", msgChecksum[0], msgChecksum[1], myChecksum[0], myChecksum[1])
+		return fmt.Errorf("downloadMessage(): Bad checksum: msgChecksum=%02x%02x, myChecksum=%02x%02x", msgChecksum[0], msgChecksum[1], myChecksum[0], myChecksum[1])
 	}
 
 	if r.msgHandler != nil {
@@ -518,14 +688,29 @@ func (r *RockBLOCKSerialConnection) SetMessageHandler(f RockBLOCKMTMessageHandle
 
 // Constantly retries each message until it is sent.
 func (r *RockBLOCKSerialConnection) persistentMessageSender() {
-	r.persistentMsgChan = make(chan []byte, 1024)
 	for {
-		m := <-r.persistentMsgChan
+		var m []byte
+		select {
+		case m = <-r.persistentMsgChan:
+		case <-r.closed:
+			return
+		}
+		wait := PERSISTENT_RETRY_BASE
 		for {
 			err := r.SendBinary(m)
-			// Try until successful.
+			// Try until successful, or until the connection is closed.
 			if err != nil {
 				fmt.Printf("send error: %s\n", err.Error())
+				select {
+				case <-time.After(wait):
+				case <-r.closed:
+					fmt.Printf("connection closed, message not sent.\n")
+					return
+				}
+				wait *= 2
+				if wait > PERSISTENT_RETRY_MAX {
+					wait = PERSISTENT_RETRY_MAX
+				}
 			} else {
 				if r.msgHandler != nil {
 					conf := RockBLOCKCallbackInfo{
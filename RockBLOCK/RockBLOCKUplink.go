@@ -0,0 +1,162 @@
+package RockBLOCK
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	UPLINK_VERSION     = 0x81 // High bit set so that it can't be mistaken for a legacy text message.
+	UPLINK_HEADER_SIZE = 3
+	UPLINK_LATLNG_SIZE = 6
+	UPLINK_TIME_SIZE   = 4
+)
+
+// Uplink flags.
+const (
+	UPLINK_FLAG_LATLNG = 0x01 // Lat/Lng follow the header.
+	UPLINK_FLAG_TIME   = 0x02 // Time follows Lat/Lng (if present).
+	uplinkFlagsKnown   = UPLINK_FLAG_LATLNG | UPLINK_FLAG_TIME
+)
+
+/*
+	Binary uplink (MO) message format:
+	 Version (1 byte, UPLINK_VERSION)
+	 RequestType (1 byte, REQUEST_*)
+	 Flags (1 byte, UPLINK_FLAG_*)
+	 If UPLINK_FLAG_LATLNG: Lat, Lng (3 bytes each, big endian, signed fraction of 90 and 180 degrees)
+	 If UPLINK_FLAG_TIME: Time (4 bytes, big endian, Unix seconds)
+	 Data, the rest of the message. Meaning depends on RequestType.
+	Lat/Lng resolution is about 1e-5 degrees.
+*/
+
+// encodeFixed24 encodes 'v' in [-span, span] as a signed 24 bit fraction of 'span'.
+func encodeFixed24(v, span float64) []byte {
+	x := int32(math.Floor(v/span*(1<<23) + 0.5))
+	if x > (1<<23)-1 {
+		x = (1 << 23) - 1
+	} else if x < -(1 << 23) {
+		x = -(1 << 23)
+	}
+	return []byte{byte(x >> 16), byte(x >> 8), byte(x)}
+}
+
+func decodeFixed24(b []byte, span float64) float64 {
+	x := int32(uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8) >> 8 // Sign extend.
+	return float64(x) / (1 << 23) * span
+}
+
+func (m IridiumMessage) Marshal() ([]byte, error) {
+	if m.RequestType < 0 || m.RequestType >= requestTypeCount {
+		return nil, fmt.Errorf("IridiumMessage.Marshal(): Unknown request type %d.", m.RequestType)
+	}
+
+	var flags byte
+	if m.LatLngPresent {
+		flags |= UPLINK_FLAG_LATLNG
+	}
+	if !m.Time.IsZero() {
+		flags |= UPLINK_FLAG_TIME
+	}
+
+	ret := []byte{UPLINK_VERSION, byte(m.RequestType), flags}
+	if m.LatLngPresent {
+		if m.Lat < -90 || m.Lat > 90 || m.Lng < -180 || m.Lng > 180 {
+			return nil, fmt.Errorf("IridiumMessage.Marshal(): Invalid position %f,%f.", m.Lat, m.Lng)
+		}
+		ret = append(ret, encodeFixed24(m.Lat, 90)...)
+		ret = append(ret, encodeFixed24(m.Lng, 180)...)
+	}
+	if !m.Time.IsZero() {
+		t := uint32(m.Time.Unix())
+		ret = append(ret, byte(t>>24), byte(t>>16), byte(t>>8), byte(t))
+	}
+	ret = append(ret, m.Data...)
+
+	if len(ret) > MAX_MO_SZ {
+		return nil, fmt.Errorf("IridiumMessage.Marshal(): Message too long (%d bytes, max %d).", len(ret), MAX_MO_SZ)
+	}
+	return ret, nil
+}
+
+func UnmarshalIridiumMessage(data []byte) (IridiumMessage, error) {
+	var ret IridiumMessage
+	if len(data) < UPLINK_HEADER_SIZE {
+		return ret, errors.New("UnmarshalIridiumMessage(): Message too short.")
+	}
+	if len(data) > MAX_MO_SZ {
+		return ret, fmt.Errorf("UnmarshalIridiumMessage(): Message too long (%d bytes).", len(data))
+	}
+	if data[0] != UPLINK_VERSION {
+		return ret, fmt.Errorf("UnmarshalIridiumMessage(): Unsupported version %02x.", data[0])
+	}
+	ret.RequestType = int(data[1])
+	if ret.RequestType >= requestTypeCount {
+		return ret, fmt.Errorf("UnmarshalIridiumMessage(): Unknown request type %d.", ret.RequestType)
+	}
+	flags := data[2]
+	if flags&^uplinkFlagsKnown != 0 {
+		return ret, fmt.Errorf("UnmarshalIridiumMessage(): Unsupported flags %02x.", flags)
+	}
+	data = data[UPLINK_HEADER_SIZE:]
+
+	if flags&UPLINK_FLAG_LATLNG != 0 {
+		if len(data) < UPLINK_LATLNG_SIZE {
+			return ret, errors.New("UnmarshalIridiumMessage(): Truncated position.")
+		}
+		ret.LatLngPresent = true
+		ret.Lat = decodeFixed24(data[0:3], 90)
+		ret.Lng = decodeFixed24(data[3:6], 180)
+		data = data[UPLINK_LATLNG_SIZE:]
+	}
+	if flags&UPLINK_FLAG_TIME != 0 {
+		if len(data) < UPLINK_TIME_SIZE {
+			return ret, errors.New("UnmarshalIridiumMessage(): Truncated time.")
+		}
+		t := uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+		ret.Time = time.Unix(int64(t), 0).UTC()
+		data = data[UPLINK_TIME_SIZE:]
+	}
+	ret.Data = data
+	return ret, nil
+}
+
+/*
+	processLegacy().
+	 Decodes the text messages sent before the binary format:
+	  "2016-08-18T17:53:00Z,42.2125,-83.3534" - status update with GPS time and position.
+	  "METAR KDTW" - METAR request.
+*/
+
+func processLegacy(data string) (IridiumMessage, error) {
+	var ret IridiumMessage
+	if strings.HasPrefix(data, "METAR ") {
+		ident := strings.TrimSpace(data[6:])
+		if len(ident) == 0 {
+			return ret, errors.New("processLegacy(): METAR request without identifier.")
+		}
+		ret.RequestType = REQUEST_METAR
+		ret.Data = []byte(ident)
+		return ret, nil
+	}
+
+	x := strings.Split(data, ",")
+	if len(x) != 3 {
+		return ret, errors.New("processLegacy(): Unrecognized message.")
+	}
+	ret.RequestType = REQUEST_NIL
+	if err := ret.Time.UnmarshalText([]byte(x[0])); err != nil {
+		return ret, fmt.Errorf("processLegacy(): Invalid time '%s'.", x[0])
+	}
+	lat, err1 := strconv.ParseFloat(x[1], 64)
+	lng, err2 := strconv.ParseFloat(x[2], 64)
+	if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return ret, fmt.Errorf("processLegacy(): Invalid position '%s,%s'.", x[1], x[2])
+	}
+	ret.LatLngPresent, ret.Lat, ret.Lng = true, lat, lng
+	return ret, nil
+}
@@ -1,7 +1,93 @@
 package RockBLOCK
 
+import (
+	"errors"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// Environment variables that override Config values.
 const (
-	CORE_USER = "cyoung@gmail.com"
-	CORE_PASS = "uxMTbJ0SeHd"
-	TEST_IMEI = "300234064321080"
+	ENV_CORE_USER = "ROCKBLOCK_USER"
+	ENV_CORE_PASS = "ROCKBLOCK_PASS"
+	ENV_TEST_IMEI = "ROCKBLOCK_TEST_IMEI"
+	ENV_CORE_URL  = "ROCKBLOCK_CORE_URL"
 )
+
+const CORE_MT_URL = "https://core.rock7.com/rockblock/MT"
+
+// Config holds the RockBLOCK web services credentials. Nothing is compiled in - set it with SetConfig().
+type Config struct {
+	COREUser string
+	COREPass string
+	TestIMEI string // Device used by the test tools.
+	COREURL  string // MT endpoint. Empty = CORE_MT_URL. Point it at a FakeCORE to test without RockBLOCK.
+}
+
+var config Config
+var configMu = &sync.Mutex{}
+
+func SetConfig(c Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	config = c
+}
+
+func GetConfig() Config {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return config
+}
+
+// ApplyEnv overrides the values of 'c' that are set in the environment.
+func (c *Config) ApplyEnv() {
+	if v := os.Getenv(ENV_CORE_USER); len(v) > 0 {
+		c.COREUser = v
+	}
+	if v := os.Getenv(ENV_CORE_PASS); len(v) > 0 {
+		c.COREPass = v
+	}
+	if v := os.Getenv(ENV_TEST_IMEI); len(v) > 0 {
+		c.TestIMEI = v
+	}
+	if v := os.Getenv(ENV_CORE_URL); len(v) > 0 {
+		c.COREURL = v
+	}
+}
+
+// MTURL is the MT endpoint to post to.
+func (c Config) MTURL() string {
+	if len(c.COREURL) == 0 {
+		return CORE_MT_URL
+	}
+	return c.COREURL
+}
+
+func validIMEI(imei string) bool {
+	if len(imei) != 15 {
+		return false
+	}
+	for _, c := range imei {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Config) Validate() error {
+	if len(c.COREUser) == 0 || len(c.COREPass) == 0 {
+		return errors.New("RockBLOCK username and password are required.")
+	}
+	if len(c.TestIMEI) > 0 && !validIMEI(c.TestIMEI) {
+		return errors.New("Invalid test IMEI.")
+	}
+	if len(c.COREURL) > 0 {
+		u, err := url.Parse(c.COREURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return errors.New("Invalid COREURL.")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package WeatherPack
+
+import (
+	"fmt"
+	"math"
+)
+
+// RangeDef is one bucket of a RangeCodec. A value v falls in it if Min <= v < Max. A bucket with Min == Max
+// matches only that exact value, and takes precedence over the bucket following it.
+type RangeDef struct {
+	Min       float64
+	Max       float64
+	StringVal string
+}
+
+/*
+	RangeCodec.
+	 Encodes numbers as the index of the bucket they fall into. The bit width and codes are derived from
+	 the ordered list of buckets: the first bucket is code 0, the width is just enough for the last code.
+	 Values below the first bucket or above the last are clamped into them.
+*/
+
+type RangeCodec struct {
+	Name   string
+	Bits   int
+	Ranges []RangeDef
+}
+
+// codeBits returns the number of bits needed for 'n' distinct codes.
+func codeBits(n int) int {
+	bits := 1
+	for (1 << uint(bits)) < n {
+		bits++
+	}
+	return bits
+}
+
+func intToBits(v, width int) []int {
+	ret := make([]int, width)
+	for i := 0; i < width; i++ {
+		ret[i] = (v >> uint(width-1-i)) & 1
+	}
+	return ret
+}
+
+func bitsToInt(bits []int) (int, error) {
+	ret := 0
+	for i, b := range bits {
+		if b != 0 && b != 1 {
+			return 0, fmt.Errorf("Invalid bit value %d at %d.", b, i)
+		}
+		ret = ret<<1 | b
+	}
+	return ret, nil
+}
+
+// NewRangeCodec checks that the buckets are in order, with no gaps or overlaps between them.
+func NewRangeCodec(name string, ranges []RangeDef) (*RangeCodec, error) {
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("%s: No ranges.", name)
+	}
+	for i, r := range ranges {
+		if r.Min > r.Max {
+			return nil, fmt.Errorf("%s: Range %d (%s) has Min %v > Max %v.", name, i, r.StringVal, r.Min, r.Max)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := ranges[i-1]
+		if r.Min > prev.Max {
+			return nil, fmt.Errorf("%s: Gap between range %d (%s) and %d (%s): %v-%v.", name, i-1, prev.StringVal, i, r.StringVal, prev.Max, r.Min)
+		}
+		if r.Min < prev.Max {
+			return nil, fmt.Errorf("%s: Range %d (%s) overlaps range %d (%s).", name, i, r.StringVal, i-1, prev.StringVal)
+		}
+		if r.Min == r.Max && prev.Min == prev.Max {
+			return nil, fmt.Errorf("%s: Duplicate value %v in ranges %d (%s) and %d (%s).", name, r.Min, i-1, prev.StringVal, i, r.StringVal)
+		}
+	}
+	return &RangeCodec{Name: name, Bits: codeBits(len(ranges)), Ranges: ranges}, nil
+}
+
+// mustRangeCodec is for the package tables - an invalid table is a bug, caught at init.
+func mustRangeCodec(name string, ranges []RangeDef) *RangeCodec {
+	c, err := NewRangeCodec(name, ranges)
+	if err != nil {
+		panic(err.Error())
+	}
+	return c
+}
+
+/*
+	StepRanges().
+	 Generates buckets of 'step' from 'min' up to 'max', labelled using 'format' with the bucket's
+	 Min and Max, e.g. StepRanges(26.0, 32.3, 0.1, "%.2f-%.2f").
+*/
+
+func StepRanges(min, max, step float64, format string) []RangeDef {
+	ret := make([]RangeDef, 0)
+	n := int(math.Floor((max-min)/step + 0.5))
+	// Computing both ends from the index keeps each Max exactly equal to the next Min.
+	edge := func(i int) float64 {
+		return math.Floor((min+float64(i)*step)*1e6+0.5) / 1e6
+	}
+	for i := 0; i < n; i++ {
+		lo, hi := edge(i), edge(i+1)
+		ret = append(ret, RangeDef{Min: lo, Max: hi, StringVal: fmt.Sprintf(format, lo, hi)})
+	}
+	return ret
+}
+
+// Code returns the code of the bucket containing 'v'.
+func (c *RangeCodec) Code(v float64) int {
+	for i, r := range c.Ranges {
+		if (r.Min == r.Max && v == r.Min) || (v >= r.Min && v < r.Max) {
+			return i
+		}
+	}
+	if v < c.Ranges[0].Min {
+		return 0
+	}
+	return len(c.Ranges) - 1
+}
+
+func (c *RangeCodec) Lookup(v float64) RangeDef {
+	return c.Ranges[c.Code(v)]
+}
+
+func (c *RangeCodec) Encode(v float64) []int {
+	return intToBits(c.Code(v), c.Bits)
+}
+
+func (c *RangeCodec) Decode(bits []int) (RangeDef, error) {
+	if len(bits) != c.Bits {
+		return RangeDef{}, fmt.Errorf("%s: Need %d bits, got %d.", c.Name, c.Bits, len(bits))
+	}
+	code, err := bitsToInt(bits)
+	if err != nil {
+		return RangeDef{}, fmt.Errorf("%s: %s", c.Name, err.Error())
+	}
+	if code >= len(c.Ranges) {
+		return RangeDef{}, fmt.Errorf("%s: Code %d out of range.", c.Name, code)
+	}
+	return c.Ranges[code], nil
+}
+
+// KeywordDef is one entry of a KeywordCodec. Any of the Keywords encode to it, the first is used when decoding.
+type KeywordDef struct {
+	Keywords  []string
+	StringVal string
+}
+
+// KeywordCodec encodes keywords as the index of their entry, in the same way as RangeCodec.
+type KeywordCodec struct {
+	Name string
+	Bits int
+	Defs []KeywordDef
+}
+
+// NewKeywordCodec checks that every entry has keywords and that no keyword appears twice.
+func NewKeywordCodec(name string, defs []KeywordDef) (*KeywordCodec, error) {
+	if len(defs) == 0 {
+		return nil, fmt.Errorf("%s: No entries.", name)
+	}
+	seen := make(map[string]int, 0)
+	for i, d := range defs {
+		if len(d.Keywords) == 0 {
+			return nil, fmt.Errorf("%s: Entry %d (%s) has no keywords.", name, i, d.StringVal)
+		}
+		for _, k := range d.Keywords {
+			if j, ok := seen[k]; ok {
+				return nil, fmt.Errorf("%s: Keyword '%s' in entries %d and %d.", name, k, j, i)
+			}
+			seen[k] = i
+		}
+	}
+	return &KeywordCodec{Name: name, Bits: codeBits(len(defs)), Defs: defs}, nil
+}
+
+func mustKeywordCodec(name string, defs []KeywordDef) *KeywordCodec {
+	c, err := NewKeywordCodec(name, defs)
+	if err != nil {
+		panic(err.Error())
+	}
+	return c
+}
+
+func (c *KeywordCodec) Code(keyword string) (int, error) {
+	for i, d := range c.Defs {
+		for _, k := range d.Keywords {
+			if k == keyword {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("%s: Unknown keyword '%s'.", c.Name, keyword)
+}
+
+func (c *KeywordCodec) Lookup(keyword string) (KeywordDef, error) {
+	code, err := c.Code(keyword)
+	if err != nil {
+		return KeywordDef{}, err
+	}
+	return c.Defs[code], nil
+}
+
+func (c *KeywordCodec) Encode(keyword string) ([]int, error) {
+	code, err := c.Code(keyword)
+	if err != nil {
+		return nil, err
+	}
+	return intToBits(code, c.Bits), nil
+}
+
+func (c *KeywordCodec) Decode(bits []int) (KeywordDef, error) {
+	if len(bits) != c.Bits {
+		return KeywordDef{}, fmt.Errorf("%s: Need %d bits, got %d.", c.Name, c.Bits, len(bits))
+	}
+	code, err := bitsToInt(bits)
+	if err != nil {
+		return KeywordDef{}, fmt.Errorf("%s: %s", c.Name, err.Error())
+	}
+	if code >= len(c.Defs) {
+		return KeywordDef{}, fmt.Errorf("%s: Code %d out of range.", c.Name, code)
+	}
+	return c.Defs[code], nil
+}
@@ -1,8 +1,442 @@
 package WeatherPack
 
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	METAR_PACKED_BITS    = 32
+	WIND_DIRECTION_VRB   = -1    // Variable wind direction.
+	CEILING_HEIGHT_NONE  = 99999 // No ceiling reported.
+	HPA_PER_INHG         = 33.8639
+	KNOTS_PER_MPS        = 1.94384
+	STATUTE_MILES_PER_M  = 0.000621371
+	METAR_VISIBILITY_MAX = 10 // Statute miles, used for CAVOK and 9999.
+)
+
 type METAR struct {
+	StationID        string
+	Time             time.Time // Day and time of the observation. Only hours and minutes survive packing.
+	Temperature      int       // ºC.
+	Dewpoint         int       // ºC.
+	WindDirection    int       // Degrees true, or WIND_DIRECTION_VRB.
+	WindVelocity     int       // Knots.
+	WindGusts        int       // Knots above WindVelocity. 0 if no gusts.
+	Visibility       float64   // Statute miles.
+	Altimeter        float64   // Inches Hg.
+	WeatherPhenomena []string  // Present weather groups as reported, e.g. "+TSRA", "BR". Groups with too many phenomena are split by splitWeatherGroup().
+	CeilingHeight    int       // Feet AGL of the lowest BKN/OVC/VV layer. Highest FEW/SCT layer if none, CEILING_HEIGHT_NONE if clear.
+	CeilingType      string    // Coverage of the layer in CeilingHeight: "CLR", "FEW", "SCT", "BKN", "OVC".
+}
+
+// isWeatherPhenomena checks if 'tok' is a present weather group like "-SHRA", "VCTS", "FZFG", "+TSRAGR".
+func isWeatherPhenomena(tok string) bool {
+	_, _, _, ok := splitWeatherPhenomena(tok)
+	return ok
+}
+
+/*
+	splitWeatherGroup().
+	 Splits a present weather group with more than WEATHER_PHENOMENA_MAX_CODES phenomena into
+	 groups that can be packed, e.g. "+TSRAGRPLSN" -> "+TSRAGRPL", "TSSN". The descriptor applies to
+	 every phenomenon so it is repeated, the intensity only qualifies the first one so it is not.
+*/
+
+func splitWeatherGroup(tok string) []string {
+	intensity, descriptor, codes, ok := splitWeatherPhenomena(tok)
+	if !ok || len(codes) <= WEATHER_PHENOMENA_MAX_CODES {
+		return []string{tok}
+	}
+	ret := make([]string, 0)
+	for i := 0; i < len(codes); i += WEATHER_PHENOMENA_MAX_CODES {
+		end := i + WEATHER_PHENOMENA_MAX_CODES
+		if end > len(codes) {
+			end = len(codes)
+		}
+		ret = append(ret, intensity+descriptor+strings.Join(codes[i:end], ""))
+		intensity = ""
+	}
+	return ret
+}
+
+// parseVisibility parses "10SM", "1/2SM", "M1/4SM", "P6SM" and ICAO meters "9999", "0800" into statute miles.
+func parseVisibility(tok string) (float64, bool) {
+	if len(tok) == 4 {
+		if m, err := strconv.Atoi(tok); err == nil {
+			if m == 9999 {
+				return METAR_VISIBILITY_MAX, true
+			}
+			return float64(m) * STATUTE_MILES_PER_M, true
+		}
+	}
+	if !strings.HasSuffix(tok, "SM") {
+		return 0, false
+	}
+	tok = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSuffix(tok, "SM"), "P"), "M")
+	if x := strings.Split(tok, "/"); len(x) == 2 {
+		n, err1 := strconv.Atoi(x[0])
+		d, err2 := strconv.Atoi(x[1])
+		if err1 != nil || err2 != nil || d == 0 {
+			return 0, false
+		}
+		return float64(n) / float64(d), true
+	}
+	v, err := strconv.Atoi(tok)
+	if err != nil {
+		return 0, false
+	}
+	return float64(v), true
+}
+
+func parseTemperature(s string) (int, error) {
+	neg := strings.HasPrefix(s, "M")
+	v, err := strconv.Atoi(strings.TrimPrefix(s, "M"))
+	if err != nil {
+		return 0, err
+	}
+	if neg {
+		v = -v
+	}
+	return v, nil
+}
+
+/*
+	ParseMETAR().
+	 Parses raw METAR text like:
+	  KDTW 181753Z 22012G20KT 1 1/2SM -SHRA BR BKN008 OVC020 18/16 A2992 RMK AO2
+	 Remarks are ignored.
+*/
+
+func ParseMETAR(text string) (*METAR, error) {
+	tokens := strings.Fields(strings.Replace(text, "=", " ", -1))
+	ret := &METAR{
+		WindDirection: WIND_DIRECTION_VRB,
+		CeilingHeight: CEILING_HEIGHT_NONE,
+		CeilingType:   "CLR",
+	}
+
+	i := 0
+	for i < len(tokens) && (tokens[i] == "METAR" || tokens[i] == "SPECI") {
+		i++
+	}
+	if i >= len(tokens) || len(tokens[i]) != 4 {
+		return nil, errors.New("ParseMETAR(): Missing station identifier.")
+	}
+	ret.StationID = tokens[i]
+	i++
+
+	if i >= len(tokens) || len(tokens[i]) != 7 || !strings.HasSuffix(tokens[i], "Z") {
+		return nil, errors.New("ParseMETAR(): Missing observation time.")
+	}
+	day, err1 := strconv.Atoi(tokens[i][0:2])
+	hour, err2 := strconv.Atoi(tokens[i][2:4])
+	minute, err3 := strconv.Atoi(tokens[i][4:6])
+	if err1 != nil || err2 != nil || err3 != nil || hour > 23 || minute > 59 {
+		return nil, fmt.Errorf("ParseMETAR(): Invalid observation time '%s'.", tokens[i])
+	}
+	ret.Time = time.Date(0, 1, day, hour, minute, 0, 0, time.UTC)
+	i++
+
+	var haveWind, haveTemp, haveAltimeter, haveVisibility bool
+	var highestCoverage int // Index into skyCoverage of the most significant non-ceiling layer seen.
+	skyCoverage := []string{"CLR", "FEW", "SCT", "BKN", "OVC"}
+	var prevWhole float64 // Whole miles of a split visibility, "1 1/2SM".
+
+	for ; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok == "RMK" {
+			break
+		}
+		switch {
+		case tok == "AUTO" || tok == "COR":
+		case !haveWind && (strings.HasSuffix(tok, "KT") || strings.HasSuffix(tok, "MPS")) && len(tok) >= 7:
+			unit := 1.0
+			speeds := strings.TrimSuffix(tok, "KT")
+			if strings.HasSuffix(tok, "MPS") {
+				unit = KNOTS_PER_MPS
+				speeds = strings.TrimSuffix(tok, "MPS")
+			}
+			if !strings.HasPrefix(speeds, "VRB") {
+				dir, err := strconv.Atoi(speeds[:3])
+				if err != nil {
+					return nil, fmt.Errorf("ParseMETAR(): Invalid wind '%s'.", tok)
+				}
+				ret.WindDirection = dir
+			}
+			x := strings.Split(speeds[3:], "G")
+			v, err := strconv.Atoi(x[0])
+			if err != nil {
+				return nil, fmt.Errorf("ParseMETAR(): Invalid wind '%s'.", tok)
+			}
+			ret.WindVelocity = int(float64(v)*unit + 0.5)
+			if len(x) == 2 {
+				g, err := strconv.Atoi(x[1])
+				if err != nil {
+					return nil, fmt.Errorf("ParseMETAR(): Invalid wind gusts '%s'.", tok)
+				}
+				ret.WindGusts = int(float64(g)*unit+0.5) - ret.WindVelocity
+				if ret.WindGusts < 0 {
+					ret.WindGusts = 0
+				}
+			}
+			haveWind = true
+		case tok == "CAVOK":
+			ret.Visibility = METAR_VISIBILITY_MAX
+			haveVisibility = true
+		case !haveVisibility && len(tok) == 1 && tok[0] >= '1' && tok[0] <= '9' && i+1 < len(tokens) && strings.HasSuffix(tokens[i+1], "SM"):
+			prevWhole = float64(tok[0] - '0')
+		case !haveVisibility && (strings.HasSuffix(tok, "SM") || (len(tok) == 4 && haveWind)):
+			if v, ok := parseVisibility(tok); ok {
+				ret.Visibility = prevWhole + v
+				haveVisibility = true
+			}
+		case tok == "CLR" || tok == "SKC" || tok == "NCD" || tok == "NSC":
+		case strings.HasPrefix(tok, "VV") || ((strings.HasPrefix(tok, "FEW") || strings.HasPrefix(tok, "SCT") || strings.HasPrefix(tok, "BKN") || strings.HasPrefix(tok, "OVC")) && len(tok) >= 6):
+			coverage := "OVC" // Vertical visibility into an obscuration counts as a ceiling.
+			heightStr := tok[2:]
+			if !strings.HasPrefix(tok, "VV") {
+				coverage = tok[:3]
+				heightStr = tok[3:]
+			}
+			if len(heightStr) < 3 {
+				break
+			}
+			h, err := strconv.Atoi(heightStr[:3])
+			if err != nil {
+				break // "///".
+			}
+			h *= 100
+			isCeiling := coverage == "BKN" || coverage == "OVC"
+			haveCeiling := ret.CeilingType == "BKN" || ret.CeilingType == "OVC"
+			if isCeiling && (!haveCeiling || h < ret.CeilingHeight) {
+				ret.CeilingHeight, ret.CeilingType = h, coverage
+			} else if !isCeiling && !haveCeiling {
+				// No ceiling (yet). Keep the most significant, lowest layer.
+				for j, c := range skyCoverage {
+					if c == coverage && (j > highestCoverage || (j == highestCoverage && h < ret.CeilingHeight)) {
+						highestCoverage = j
+						ret.CeilingHeight, ret.CeilingType = h, coverage
+					}
+				}
+			}
+		case !haveTemp && strings.Contains(tok, "/") && !strings.HasSuffix(tok, "SM"):
+			x := strings.Split(tok, "/")
+			if len(x) != 2 {
+				break
+			}
+			t, err := parseTemperature(x[0])
+			if err != nil {
+				break
+			}
+			d, err := parseTemperature(x[1])
+			if err != nil {
+				d = t // Dewpoint missing.
+			}
+			ret.Temperature, ret.Dewpoint = t, d
+			haveTemp = true
+		case !haveAltimeter && len(tok) == 5 && (tok[0] == 'A' || tok[0] == 'Q'):
+			v, err := strconv.Atoi(tok[1:])
+			if err != nil {
+				break
+			}
+			if tok[0] == 'A' {
+				ret.Altimeter = float64(v) / 100.0
+			} else {
+				ret.Altimeter = float64(v) / HPA_PER_INHG
+			}
+			haveAltimeter = true
+		case isWeatherPhenomena(tok):
+			ret.WeatherPhenomena = append(ret.WeatherPhenomena, splitWeatherGroup(tok)...)
+		}
+	}
+
+	if !haveWind || !haveVisibility || !haveTemp || !haveAltimeter {
+		return nil, fmt.Errorf("ParseMETAR(): Incomplete METAR: wind=%t, visibility=%t, temperature=%t, altimeter=%t.", haveWind, haveVisibility, haveTemp, haveAltimeter)
+	}
+
+	return ret, nil
+}
+
+// WeatherPresent is a single bit flag for whether present weather groups follow the fixed METAR_PACKED_BITS.
+type WeatherPresent bool
+
+func (w WeatherPresent) Pack() []int {
+	if w {
+		return []int{1}
+	}
+	return []int{0}
+}
+
+func (w *WeatherPresent) Unpack(data []int) error {
+	if len(data) != 1 {
+		return errors.New("Invalid length.")
+	}
+	*w = data[0] == 1
+	return nil
+}
+
+func (w WeatherPresent) String() string {
+	if w {
+		return "WX"
+	}
+	return "NOWX"
+}
+
+/*
+	PackedMETAR.
+	 The packed form of a METAR, as sent over the air. The station identifier is not included.
+	 The fields tagged below make up the first METAR_PACKED_BITS. If Weather is set, they are followed by:
+	  Number of groups (2 bits)
+	  Each group as packed by WeatherPhenomena.Pack()
+	 padded with zeros to a whole byte.
+*/
+
+type PackedMETAR struct {
+	Time          WeatherCollectionTime `weatherpack:"8"`
+	Spread        TempDewpointSpread    `weatherpack:"3"`
+	WindDirection WindDirection         `weatherpack:"3"`
+	WindVelocity  WindVelocity          `weatherpack:"2"`
+	WindGusts     WindVelocityGusts     `weatherpack:"2"`
+	Visibility    Visibility            `weatherpack:"2"`
+	Altimeter     Altimeter             `weatherpack:"6"`
+	Weather       WeatherPresent        `weatherpack:"1"`
+	CeilingHeight CeilingHeight         `weatherpack:"3"`
+	CeilingType   CeilingType           `weatherpack:"2"`
+
+	WeatherPhenomena []WeatherPhenomena `weatherpack:"-"`
+}
+
+// String gives a human readable summary for display on the receiving end.
+func (p PackedMETAR) String() string {
+	wx := p.Weather.String()
+	if len(p.WeatherPhenomena) > 0 {
+		groups := make([]string, 0)
+		for _, w := range p.WeatherPhenomena {
+			groups = append(groups, w.String())
+		}
+		wx = strings.Join(groups, " ")
+	}
+	return fmt.Sprintf("%s T-Td %s wind %s %s gust %s vis %s alt %s %s ceiling %s %s",
+		p.Time, p.Spread, p.WindDirection, p.WindVelocity, p.WindGusts, p.Visibility, p.Altimeter, wx, p.CeilingType, p.CeilingHeight)
+}
+
+func packWeatherPhenomena(groups []WeatherPhenomena) ([]byte, error) {
+	if len(groups) == 0 || len(groups) > WEATHER_PHENOMENA_MAX_GROUPS {
+		return nil, fmt.Errorf("Invalid number of weather groups %d.", len(groups))
+	}
+	bits := intToBits(len(groups), codeBits(WEATHER_PHENOMENA_MAX_GROUPS+1))
+	for _, w := range groups {
+		b := w.Pack()
+		if b == nil {
+			return nil, fmt.Errorf("Invalid weather group '%s'.", w)
+		}
+		bits = append(bits, b...)
+	}
+	return bitsToBytes(bits), nil
+}
+
+func unpackWeatherPhenomena(data []byte) ([]WeatherPhenomena, error) {
+	bits := bytesToBits(data)
+	countBits := codeBits(WEATHER_PHENOMENA_MAX_GROUPS + 1)
+	if len(bits) < countBits {
+		return nil, errors.New("Missing weather groups.")
+	}
+	n, _ := bitsToInt(bits[:countBits])
+	if n == 0 || n > WEATHER_PHENOMENA_MAX_GROUPS {
+		return nil, fmt.Errorf("Invalid number of weather groups %d.", n)
+	}
+	groupBits := weatherPhenomenaBits()
+	end := countBits + n*groupBits
+	if len(data) != (end+7)/8 {
+		return nil, fmt.Errorf("Weather groups are %d bytes, expected %d.", len(data), (end+7)/8)
+	}
+	ret := make([]WeatherPhenomena, n)
+	for i := range ret {
+		pos := countBits + i*groupBits
+		if err := ret[i].Unpack(bits[pos : pos+groupBits]); err != nil {
+			return nil, fmt.Errorf("Weather group %d: %s", i, err.Error())
+		}
+	}
+	for i := end; i < len(bits); i++ {
+		if bits[i] != 0 {
+			return nil, fmt.Errorf("Non-zero padding bit %d.", i)
+		}
+	}
+	return ret, nil
+}
+
+// PackMETAR packs a METAR as laid out in PackedMETAR: METAR_PACKED_BITS, plus the present weather groups if there are any.
+func PackMETAR(m *METAR) ([]byte, error) {
+	spread := m.Temperature - m.Dewpoint
+	if spread < 0 {
+		spread = 0
+	}
+	windDirection := m.WindDirection
+	if windDirection == WIND_DIRECTION_VRB {
+		windDirection = 0
+	}
+	if _, err := ceilingTypeCodec.Lookup(m.CeilingType); err != nil {
+		return nil, fmt.Errorf("PackMETAR(): %s", err.Error())
+	}
+	weather := make([]WeatherPhenomena, 0)
+	for _, w := range m.WeatherPhenomena {
+		if len(weather) == WEATHER_PHENOMENA_MAX_GROUPS {
+			break // No more are allowed in a METAR, and they are reported in order of significance.
+		}
+		weather = append(weather, WeatherPhenomena(w))
+	}
+
+	p := PackedMETAR{
+		Time:          WeatherCollectionTime(m.Time),
+		Spread:        TempDewpointSpread(spread),
+		WindDirection: WindDirection(windDirection),
+		WindVelocity:  WindVelocity(m.WindVelocity),
+		WindGusts:     WindVelocityGusts(m.WindGusts),
+		Visibility:    Visibility(math.Floor(m.Visibility)),
+		Altimeter:     Altimeter(m.Altimeter),
+		Weather:       WeatherPresent(len(weather) > 0),
+		CeilingHeight: CeilingHeight(m.CeilingHeight),
+		CeilingType:   CeilingType(m.CeilingType),
+	}
+	ret, err := Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("PackMETAR(): %s", err.Error())
+	}
+	if len(weather) > 0 {
+		wx, err := packWeatherPhenomena(weather)
+		if err != nil {
+			return nil, fmt.Errorf("PackMETAR(): %s", err.Error())
+		}
+		ret = append(ret, wx...)
+	}
+	return ret, nil
 }
 
-func PackMETAR(time_hour, time_minute, temperature, dewpoint, wind_direction, wind_velocity, visibility int, altimeter float64, weather_phenomena []string, ceiling_height int, ceiling_type string, notification bool) []byte {
-	return []byte{}
+// UnpackMETAR is the reverse of PackMETAR(). Values are set to the bottom of the range they were packed into.
+func UnpackMETAR(data []byte) (*PackedMETAR, error) {
+	ret := new(PackedMETAR)
+	n := METAR_PACKED_BITS / 8
+	if len(data) < n {
+		return nil, fmt.Errorf("UnpackMETAR(): Input is %d bytes, expected at least %d.", len(data), n)
+	}
+	if err := Unmarshal(data[:n], ret); err != nil {
+		return nil, fmt.Errorf("UnpackMETAR(): %s", err.Error())
+	}
+	if !ret.Weather {
+		if len(data) != n {
+			return nil, fmt.Errorf("UnpackMETAR(): Input is %d bytes, expected %d.", len(data), n)
+		}
+		return ret, nil
+	}
+	wx, err := unpackWeatherPhenomena(data[n:])
+	if err != nil {
+		return nil, fmt.Errorf("UnpackMETAR(): %s", err.Error())
+	}
+	ret.WeatherPhenomena = wx
+	return ret, nil
 }
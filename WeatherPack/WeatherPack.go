@@ -2,7 +2,11 @@ package WeatherPack
 
 import (
 	"errors"
+	"fmt"
 	"math"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,8 +26,8 @@ type WindVelocityGusts int  // Knots (max).
 type Visibility int         // Statute miles.
 type Altimeter float64      // Inches hG.
 type WeatherPhenomena string
-type CeilingHeight string
-type CeilingType string
+type CeilingHeight int  // Feet AGL.
+type CeilingType string // "CLR", "FEW", "SCT", "BKN", "OVC".
 
 // 8 bits, hh:mm. Minutes rounded to tens.
 func (t WeatherCollectionTime) Pack() []int {
@@ -40,7 +44,7 @@ func (t WeatherCollectionTime) Pack() []int {
 		roundedMinutes = 0
 		hr++
 		if hr == 24 {
-			roundedHours = 0
+			hr = 0
 		}
 	}
 
@@ -67,153 +71,516 @@ func (t *WeatherCollectionTime) Unpack(data []int) error {
 	return nil
 }
 
-type IntDecode struct {
-	Min       int
-	Max       int
-	BitVal    []int
-	StringVal int
-}
-
-var tempDewpointDecode = []IntDecode{
-	{Min: 0, Max: 1, BitVal: []int{0, 0, 0}, StringVal: "0ºC"},
-	{Min: 1, Max: 2, BitVal: []int{0, 0, 1}, StringVal: "1ºC"},
-	{Min: 2, Max: 3, BitVal: []int{0, 1, 0}, StringVal: "2ºC"},
-	{Min: 3, Max: 4, BitVal: []int{0, 1, 1}, StringVal: "3ºC"},
-	{Min: 4, Max: 5, BitVal: []int{1, 0, 0}, StringVal: "4ºC"},
-	{Min: 5, Max: 6, BitVal: []int{1, 0, 1}, StringVal: "5ºC"},
-	{Min: 6, Max: 7, BitVal: []int{1, 1, 0}, StringVal: "6ºC"},
-	{Min: 7, Max: 8, BitVal: []int{1, 1, 1}, StringVal: ">=7ºC"},
-}
-
-var windDirectionDecode = []IntDecode{
-	{Min: 0, Max: 45, BitVal: []int{0, 0, 0}, StringVal: "0-45"},
-	{Min: 45, Max: 90, BitVal: []int{0, 0, 1}, StringVal: "45-90"},
-	{Min: 90, Max: 135, BitVal: []int{0, 1, 0}, StringVal: "90-135"},
-	{Min: 135, Max: 180, BitVal: []int{0, 1, 1}, StringVal: "135-180"},
-	{Min: 180, Max: 225, BitVal: []int{1, 0, 0}, StringVal: "180-225"},
-	{Min: 225, Max: 270, BitVal: []int{1, 0, 1}, StringVal: "225-270"},
-	{Min: 270, Max: 315, BitVal: []int{1, 1, 0}, StringVal: "270-315"},
-	{Min: 315, Max: 360, BitVal: []int{1, 1, 1}, StringVal: "315-360"},
-}
-
-var windVelocityDecode = []IntDecode{
-	{Min: 0, Max: 10, BitVal: []int{0, 0}, StringVal: "=<10kts"},
-	{Min: 10, Max: 15, BitVal: []int{0, 1}, StringVal: "10-15kts"},
-	{Min: 15, Max: 20, BitVal: []int{1, 0}, StringVal: "15-20kts"},
-	{Min: 20, Max: 99999, BitVal: []int{1, 1}, StringVal: ">20kts"},
-}
-
-var windVelocityGustsDecode = []IntDecode{
-	{Min: 0, Max: 0, BitVal: []int{0, 0}, StringVal: "0kts"},
-	{Min: 0, Max: 5, BitVal: []int{0, 1}, StringVal: "0-5kts"},
-	{Min: 5, Max: 15, BitVal: []int{1, 0}, StringVal: "5-15kts"},
-	{Min: 15, Max: 99999, BitVal: []int{1, 1}, StringVal: ">15kts"},
-}
-
-var visibilityDecode = []IntDecode{
-	{Min: 0, Max: 1, BitVal: []int{0, 0}, StringVal: "0-1sm"},
-	{Min: 1, Max: 3, BitVal: []int{0, 1}, StringVal: "1-3sm"},
-	{Min: 3, Max: 5, BitVal: []int{1, 0}, StringVal: "3-5sm"},
-	{Min: 5, Max: 99999, BitVal: []int{1, 1}, StringVal: ">5sm"},
-}
-
-var altimeterDecode = []IntDecode{
-	{Min: -1.00, Max: 26.0, BitVal: []int{0, 0, 0, 0, 0, 0}, StringVal: "<26.00"},
-	{Min: 26.00, Max: 26.10, BitVal: []int{0, 0, 0, 0, 0, 1}, StringVal: "26.00-26.10"},
-	{Min: 26.10, Max: 26.20, BitVal: []int{0, 0, 0, 0, 1, 0}, StringVal: "26.10-26.20"},
-	{Min: 26.20, Max: 26.30, BitVal: []int{0, 0, 0, 0, 1, 1}, StringVal: "26.20-26.30"},
-	{Min: 26.30, Max: 26.40, BitVal: []int{0, 0, 0, 1, 0, 0}, StringVal: "26.30-26.40"},
-	{Min: 26.40, Max: 26.50, BitVal: []int{0, 0, 0, 1, 0, 1}, StringVal: "26.40-26.50"},
-	{Min: 26.50, Max: 26.60, BitVal: []int{0, 0, 0, 1, 1, 0}, StringVal: "26.50-26.60"},
-	{Min: 26.60, Max: 26.70, BitVal: []int{0, 0, 0, 1, 1, 1}, StringVal: "26.60-26.70"},
-	{Min: 26.70, Max: 26.80, BitVal: []int{0, 0, 1, 0, 0, 0}, StringVal: "26.70-26.80"},
-	{Min: 26.80, Max: 26.90, BitVal: []int{0, 0, 1, 0, 0, 1}, StringVal: "26.80-26.90"},
-	{Min: 26.90, Max: 27.00, BitVal: []int{0, 0, 1, 0, 1, 0}, StringVal: "26.90-27.00"},
-	{Min: 27.00, Max: 27.10, BitVal: []int{0, 0, 1, 0, 1, 1}, StringVal: "27.00-27.10"},
-	{Min: 27.10, Max: 27.20, BitVal: []int{0, 0, 1, 1, 0, 0}, StringVal: "27.10-27.20"},
-	{Min: 27.20, Max: 27.30, BitVal: []int{0, 0, 1, 1, 0, 1}, StringVal: "27.20-27.30"},
-	{Min: 27.30, Max: 27.40, BitVal: []int{0, 0, 1, 1, 1, 0}, StringVal: "27.30-27.40"},
-	{Min: 27.40, Max: 27.50, BitVal: []int{0, 0, 1, 1, 1, 1}, StringVal: "27.40-27.50"},
-	{Min: 27.50, Max: 27.60, BitVal: []int{0, 1, 0, 0, 0, 0}, StringVal: "27.50-27.60"},
-	{Min: 27.60, Max: 27.70, BitVal: []int{0, 1, 0, 0, 0, 1}, StringVal: "27.60-27.70"},
-	{Min: 27.70, Max: 27.80, BitVal: []int{0, 1, 0, 0, 1, 0}, StringVal: "27.70-27.80"},
-	{Min: 27.80, Max: 27.90, BitVal: []int{0, 1, 0, 0, 1, 1}, StringVal: "27.80-27.90"},
-	{Min: 27.90, Max: 28.00, BitVal: []int{0, 1, 0, 1, 0, 0}, StringVal: "27.90-28.00"},
-	{Min: 28.00, Max: 28.10, BitVal: []int{0, 1, 0, 1, 0, 1}, StringVal: "28.00-28.10"},
-	{Min: 28.10, Max: 28.20, BitVal: []int{0, 1, 0, 1, 1, 0}, StringVal: "28.10-28.20"},
-	{Min: 28.20, Max: 28.30, BitVal: []int{0, 1, 0, 1, 1, 1}, StringVal: "28.20-28.30"},
-	{Min: 28.30, Max: 28.40, BitVal: []int{0, 1, 1, 0, 0, 0}, StringVal: "28.30-28.40"},
-	{Min: 28.40, Max: 28.50, BitVal: []int{0, 1, 1, 0, 0, 1}, StringVal: "28.40-28.50"},
-	{Min: 28.50, Max: 28.60, BitVal: []int{0, 1, 1, 0, 1, 0}, StringVal: "28.50-28.60"},
-	{Min: 28.60, Max: 28.70, BitVal: []int{0, 1, 1, 0, 1, 1}, StringVal: "28.60-28.70"},
-	{Min: 28.70, Max: 28.80, BitVal: []int{0, 1, 1, 1, 0, 0}, StringVal: "28.70-28.80"},
-	{Min: 28.80, Max: 28.90, BitVal: []int{0, 1, 1, 1, 0, 1}, StringVal: "28.80-28.90"},
-	{Min: 28.90, Max: 29.00, BitVal: []int{0, 1, 1, 1, 1, 0}, StringVal: "28.90-29.00"},
-	{Min: 29.00, Max: 29.10, BitVal: []int{0, 1, 1, 1, 1, 1}, StringVal: "29.00-29.10"},
-	{Min: 29.10, Max: 29.20, BitVal: []int{1, 0, 0, 0, 0, 0}, StringVal: "29.10-29.20"},
-	{Min: 29.20, Max: 29.30, BitVal: []int{1, 0, 0, 0, 0, 1}, StringVal: "29.20-29.30"},
-	{Min: 29.30, Max: 29.40, BitVal: []int{1, 0, 0, 0, 1, 0}, StringVal: "29.30-29.40"},
-	{Min: 29.40, Max: 29.50, BitVal: []int{1, 0, 0, 0, 1, 1}, StringVal: "29.40-29.50"},
-	{Min: 29.50, Max: 29.60, BitVal: []int{1, 0, 0, 1, 0, 0}, StringVal: "29.50-29.60"},
-	{Min: 29.60, Max: 29.70, BitVal: []int{1, 0, 0, 1, 0, 1}, StringVal: "29.60-29.70"},
-	{Min: 29.70, Max: 29.80, BitVal: []int{1, 0, 0, 1, 1, 0}, StringVal: "29.70-29.80"},
-	{Min: 29.80, Max: 29.90, BitVal: []int{1, 0, 0, 1, 1, 1}, StringVal: "29.80-29.90"},
-	{Min: 29.90, Max: 30.00, BitVal: []int{1, 0, 1, 0, 0, 0}, StringVal: "29.90-30.00"},
-	{Min: 30.00, Max: 30.10, BitVal: []int{1, 0, 1, 0, 0, 1}, StringVal: "30.00-30.10"},
-	{Min: 30.10, Max: 30.20, BitVal: []int{1, 0, 1, 0, 1, 0}, StringVal: "30.10-30.20"},
-	{Min: 30.20, Max: 30.30, BitVal: []int{1, 0, 1, 0, 1, 1}, StringVal: "30.20-30.30"},
-	{Min: 30.30, Max: 30.40, BitVal: []int{1, 0, 1, 1, 0, 0}, StringVal: "30.30-30.40"},
-	{Min: 30.40, Max: 30.50, BitVal: []int{1, 0, 1, 1, 0, 1}, StringVal: "30.40-30.50"},
-	{Min: 30.50, Max: 30.60, BitVal: []int{1, 0, 1, 1, 1, 0}, StringVal: "30.50-30.60"},
-	{Min: 30.60, Max: 30.70, BitVal: []int{1, 0, 1, 1, 1, 1}, StringVal: "30.60-30.70"},
-	{Min: 30.70, Max: 30.80, BitVal: []int{1, 1, 0, 0, 0, 0}, StringVal: "30.70-30.80"},
-	{Min: 30.80, Max: 30.90, BitVal: []int{1, 1, 0, 0, 0, 1}, StringVal: "30.80-30.90"},
-	{Min: 30.90, Max: 31.00, BitVal: []int{1, 1, 0, 0, 1, 0}, StringVal: "30.90-31.00"},
-	{Min: 31.00, Max: 31.10, BitVal: []int{1, 1, 0, 0, 1, 1}, StringVal: "31.00-31.10"},
-	{Min: 31.10, Max: 31.20, BitVal: []int{1, 1, 0, 1, 0, 0}, StringVal: "31.10-31.20"},
-	{Min: 31.20, Max: 31.30, BitVal: []int{1, 1, 0, 1, 0, 1}, StringVal: "31.20-31.30"},
-	{Min: 31.30, Max: 31.40, BitVal: []int{1, 1, 0, 1, 1, 0}, StringVal: "31.30-31.40"},
-	{Min: 31.40, Max: 31.50, BitVal: []int{1, 1, 0, 1, 1, 1}, StringVal: "31.40-31.50"},
-	{Min: 31.50, Max: 31.60, BitVal: []int{1, 1, 1, 0, 0, 0}, StringVal: "31.50-31.60"},
-	{Min: 31.60, Max: 31.70, BitVal: []int{1, 1, 1, 0, 0, 1}, StringVal: "31.60-31.70"},
-	{Min: 31.70, Max: 31.80, BitVal: []int{1, 1, 1, 0, 1, 0}, StringVal: "31.70-31.80"},
-	{Min: 31.80, Max: 31.90, BitVal: []int{1, 1, 1, 0, 1, 1}, StringVal: "31.80-31.90"},
-	{Min: 31.90, Max: 32.00, BitVal: []int{1, 1, 1, 1, 0, 0}, StringVal: "31.90-32.00"},
-	{Min: 32.00, Max: 32.10, BitVal: []int{1, 1, 1, 1, 0, 1}, StringVal: "32.00-32.10"},
-	{Min: 32.10, Max: 32.20, BitVal: []int{1, 1, 1, 1, 1, 0}, StringVal: "32.10-32.20"},
-	{Min: 32.20, Max: 32.30, BitVal: []int{1, 1, 1, 1, 1, 1}, StringVal: "32.20-32.30"},
-}
-
-var ceilingHeightDecode = []IntDecode{
-	{Min: -1, Max: 200, BitVal: []int{0, 0, 0}, StringVal: "<200ft"},
-	{Min: 200, Max: 300, BitVal: []int{0, 0, 1}, StringVal: "200-300ft"},
-	{Min: 300, Max: 400, BitVal: []int{0, 0, 1}, StringVal: "300-400ft"},
-	{Min: 400, Max: 600, BitVal: []int{0, 0, 1}, StringVal: "400-600ft"},
-	{Min: 600, Max: 800, BitVal: []int{0, 0, 1}, StringVal: "600-800ft"},
-	{Min: 800, Max: 1000, BitVal: []int{0, 0, 1}, StringVal: "800-1000ft"},
-	{Min: 1000, Max: 1500, BitVal: []int{0, 0, 1}, StringVal: "1000-1500ft"},
-	{Min: 1500, Max: 99999, BitVal: []int{0, 0, 1}, StringVal: ">1500ft"},
-}
-
-type StringDecode struct {
-	Keywords  []string
-	BitVal    []int
-	StringVal string
-}
-
-var ceilingTypeDecode = []StringDecode{
-	{Keywords: []string{"CLR", "FEW"}, BitVal: []int{0, 0}, StringVal: "CLR-FEW"},
-	{Keywords: []string{"SCT"}, BitVal: []int{0, 1}, StringVal: "SCT"},
-	{Keywords: []string{"BKN"}, BitVal: []int{1, 0}, StringVal: "BKN"},
-	{Keywords: []string{"OVC"}, BitVal: []int{1, 1}, StringVal: "OVC"},
+func (t WeatherCollectionTime) String() string {
+	return time.Time(t).Format("15:04Z")
 }
 
+var tempDewpointCodec = mustRangeCodec("tempDewpoint", []RangeDef{
+	{Min: 0, Max: 1, StringVal: "0ºC"},
+	{Min: 1, Max: 2, StringVal: "1ºC"},
+	{Min: 2, Max: 3, StringVal: "2ºC"},
+	{Min: 3, Max: 4, StringVal: "3ºC"},
+	{Min: 4, Max: 5, StringVal: "4ºC"},
+	{Min: 5, Max: 6, StringVal: "5ºC"},
+	{Min: 6, Max: 7, StringVal: "6ºC"},
+	{Min: 7, Max: 8, StringVal: ">=7ºC"},
+})
+
+var windDirectionCodec = mustRangeCodec("windDirection", StepRanges(0, 360, 45, "%.0f-%.0f"))
+
+var windVelocityCodec = mustRangeCodec("windVelocity", []RangeDef{
+	{Min: 0, Max: 10, StringVal: "=<10kts"},
+	{Min: 10, Max: 15, StringVal: "10-15kts"},
+	{Min: 15, Max: 20, StringVal: "15-20kts"},
+	{Min: 20, Max: 99999, StringVal: ">20kts"},
+})
+
+var windVelocityGustsCodec = mustRangeCodec("windVelocityGusts", []RangeDef{
+	{Min: 0, Max: 0, StringVal: "0kts"},
+	{Min: 0, Max: 5, StringVal: "0-5kts"},
+	{Min: 5, Max: 15, StringVal: "5-15kts"},
+	{Min: 15, Max: 99999, StringVal: ">15kts"},
+})
+
+var visibilityCodec = mustRangeCodec("visibility", []RangeDef{
+	{Min: 0, Max: 1, StringVal: "0-1sm"},
+	{Min: 1, Max: 3, StringVal: "1-3sm"},
+	{Min: 3, Max: 5, StringVal: "3-5sm"},
+	{Min: 5, Max: 99999, StringVal: ">5sm"},
+})
+
+var altimeterCodec = mustRangeCodec("altimeter", append([]RangeDef{
+	{Min: -1.00, Max: 26.00, StringVal: "<26.00"},
+}, StepRanges(26.00, 32.30, 0.10, "%.2f-%.2f")...))
+
+var ceilingHeightCodec = mustRangeCodec("ceilingHeight", []RangeDef{
+	{Min: -1, Max: 200, StringVal: "<200ft"},
+	{Min: 200, Max: 300, StringVal: "200-300ft"},
+	{Min: 300, Max: 400, StringVal: "300-400ft"},
+	{Min: 400, Max: 600, StringVal: "400-600ft"},
+	{Min: 600, Max: 800, StringVal: "600-800ft"},
+	{Min: 800, Max: 1000, StringVal: "800-1000ft"},
+	{Min: 1000, Max: 1500, StringVal: "1000-1500ft"},
+	{Min: 1500, Max: 99999, StringVal: ">1500ft"},
+})
+
+var ceilingTypeCodec = mustKeywordCodec("ceilingType", []KeywordDef{
+	{Keywords: []string{"CLR", "FEW"}, StringVal: "CLR-FEW"},
+	{Keywords: []string{"SCT"}, StringVal: "SCT"},
+	{Keywords: []string{"BKN"}, StringVal: "BKN"},
+	{Keywords: []string{"OVC"}, StringVal: "OVC"},
+})
+
+// Codec-driven WeatherPacker/WeatherUnpacker implementations. Unpack() sets the value to the bottom
+// of the decoded range, String() gives the range as text.
+
+func (v TempDewpointSpread) Pack() []int {
+	return tempDewpointCodec.Encode(float64(v))
+}
+
+func (v *TempDewpointSpread) Unpack(data []int) error {
+	r, err := tempDewpointCodec.Decode(data)
+	if err != nil {
+		return err
+	}
+	*v = TempDewpointSpread(r.Min)
+	return nil
+}
+
+func (v TempDewpointSpread) String() string {
+	return tempDewpointCodec.Lookup(float64(v)).StringVal
+}
+
+func (v WindDirection) Pack() []int {
+	return windDirectionCodec.Encode(float64(int(v) % 360))
+}
+
+func (v *WindDirection) Unpack(data []int) error {
+	r, err := windDirectionCodec.Decode(data)
+	if err != nil {
+		return err
+	}
+	*v = WindDirection(r.Min)
+	return nil
+}
+
+func (v WindDirection) String() string {
+	return windDirectionCodec.Lookup(float64(int(v) % 360)).StringVal
+}
+
+func (v WindVelocity) Pack() []int {
+	return windVelocityCodec.Encode(float64(v))
+}
+
+func (v *WindVelocity) Unpack(data []int) error {
+	r, err := windVelocityCodec.Decode(data)
+	if err != nil {
+		return err
+	}
+	*v = WindVelocity(r.Min)
+	return nil
+}
+
+func (v WindVelocity) String() string {
+	return windVelocityCodec.Lookup(float64(v)).StringVal
+}
+
+func (v WindVelocityGusts) Pack() []int {
+	return windVelocityGustsCodec.Encode(float64(v))
+}
+
+func (v *WindVelocityGusts) Unpack(data []int) error {
+	r, err := windVelocityGustsCodec.Decode(data)
+	if err != nil {
+		return err
+	}
+	*v = WindVelocityGusts(r.Min)
+	return nil
+}
+
+func (v WindVelocityGusts) String() string {
+	return windVelocityGustsCodec.Lookup(float64(v)).StringVal
+}
+
+func (v Visibility) Pack() []int {
+	return visibilityCodec.Encode(float64(v))
+}
+
+func (v *Visibility) Unpack(data []int) error {
+	r, err := visibilityCodec.Decode(data)
+	if err != nil {
+		return err
+	}
+	*v = Visibility(r.Min)
+	return nil
+}
+
+func (v Visibility) String() string {
+	return visibilityCodec.Lookup(float64(v)).StringVal
+}
+
+func (v Altimeter) Pack() []int {
+	return altimeterCodec.Encode(float64(v))
+}
+
+func (v *Altimeter) Unpack(data []int) error {
+	r, err := altimeterCodec.Decode(data)
+	if err != nil {
+		return err
+	}
+	*v = Altimeter(r.Min)
+	return nil
+}
+
+func (v Altimeter) String() string {
+	return altimeterCodec.Lookup(float64(v)).StringVal
+}
+
+func (v CeilingHeight) Pack() []int {
+	return ceilingHeightCodec.Encode(float64(v))
+}
+
+func (v *CeilingHeight) Unpack(data []int) error {
+	r, err := ceilingHeightCodec.Decode(data)
+	if err != nil {
+		return err
+	}
+	*v = CeilingHeight(r.Min)
+	return nil
+}
+
+func (v CeilingHeight) String() string {
+	return ceilingHeightCodec.Lookup(float64(v)).StringVal
+}
+
+// Pack returns nil for an unknown coverage keyword.
+func (v CeilingType) Pack() []int {
+	ret, err := ceilingTypeCodec.Encode(string(v))
+	if err != nil {
+		return nil
+	}
+	return ret
+}
+
+func (v *CeilingType) Unpack(data []int) error {
+	d, err := ceilingTypeCodec.Decode(data)
+	if err != nil {
+		return err
+	}
+	*v = CeilingType(d.Keywords[0])
+	return nil
+}
+
+func (v CeilingType) String() string {
+	d, err := ceilingTypeCodec.Lookup(string(v))
+	if err != nil {
+		return string(v)
+	}
+	return d.StringVal
+}
+
+const (
+	WEATHER_PHENOMENA_MAX_CODES  = 3 // Phenomena in one group, e.g. "+TSRAGRPL".
+	WEATHER_PHENOMENA_MAX_GROUPS = 3 // Groups in one METAR.
+)
+
+var weatherIntensityCodec = mustKeywordCodec("weatherIntensity", []KeywordDef{
+	{Keywords: []string{""}, StringVal: "moderate"},
+	{Keywords: []string{"-"}, StringVal: "light"},
+	{Keywords: []string{"+"}, StringVal: "heavy"},
+	{Keywords: []string{"VC"}, StringVal: "in the vicinity"},
+})
+
+var weatherDescriptorCodec = mustKeywordCodec("weatherDescriptor", []KeywordDef{
+	{Keywords: []string{""}, StringVal: ""},
+	{Keywords: []string{"MI"}, StringVal: "shallow"},
+	{Keywords: []string{"PR"}, StringVal: "partial"},
+	{Keywords: []string{"BC"}, StringVal: "patches"},
+	{Keywords: []string{"DR"}, StringVal: "low drifting"},
+	{Keywords: []string{"BL"}, StringVal: "blowing"},
+	{Keywords: []string{"SH"}, StringVal: "showers"},
+	{Keywords: []string{"TS"}, StringVal: "thunderstorm"},
+	{Keywords: []string{"FZ"}, StringVal: "freezing"},
+})
+
+// Precipitation, then obscurations, then other phenomena.
+var weatherPhenomenaCodec = mustKeywordCodec("weatherPhenomena", []KeywordDef{
+	{Keywords: []string{""}, StringVal: ""},
+	{Keywords: []string{"DZ"}, StringVal: "drizzle"},
+	{Keywords: []string{"RA"}, StringVal: "rain"},
+	{Keywords: []string{"SN"}, StringVal: "snow"},
+	{Keywords: []string{"SG"}, StringVal: "snow grains"},
+	{Keywords: []string{"IC"}, StringVal: "ice crystals"},
+	{Keywords: []string{"PL"}, StringVal: "ice pellets"},
+	{Keywords: []string{"GR"}, StringVal: "hail"},
+	{Keywords: []string{"GS"}, StringVal: "small hail"},
+	{Keywords: []string{"UP"}, StringVal: "unknown precipitation"},
+	{Keywords: []string{"BR"}, StringVal: "mist"},
+	{Keywords: []string{"FG"}, StringVal: "fog"},
+	{Keywords: []string{"FU"}, StringVal: "smoke"},
+	{Keywords: []string{"VA"}, StringVal: "volcanic ash"},
+	{Keywords: []string{"DU"}, StringVal: "dust"},
+	{Keywords: []string{"SA"}, StringVal: "sand"},
+	{Keywords: []string{"HZ"}, StringVal: "haze"},
+	{Keywords: []string{"PY"}, StringVal: "spray"},
+	{Keywords: []string{"PO"}, StringVal: "dust whirls"},
+	{Keywords: []string{"SQ"}, StringVal: "squalls"},
+	{Keywords: []string{"FC"}, StringVal: "funnel cloud"},
+	{Keywords: []string{"SS"}, StringVal: "sandstorm"},
+	{Keywords: []string{"DS"}, StringVal: "duststorm"},
+})
+
+/*
+	splitWeatherPhenomena().
+	 Splits a present weather group into intensity ("", "-", "+", "VC"), descriptor ("" or e.g. "TS")
+	 and phenomena, e.g. "+TSRAGR" -> "+", "TS", ["RA", "GR"]. There may be more phenomena than
+	 WEATHER_PHENOMENA_MAX_CODES, see splitWeatherGroup(). Returns false if 'tok' is not a present
+	 weather group.
+*/
+
+func splitWeatherPhenomena(tok string) (string, string, []string, bool) {
+	var intensity, descriptor string
+	for _, p := range []string{"+", "-", "VC"} {
+		if strings.HasPrefix(tok, p) {
+			intensity = p
+			tok = tok[len(p):]
+			break
+		}
+	}
+	if len(tok) >= 2 {
+		if _, err := weatherDescriptorCodec.Code(tok[:2]); err == nil {
+			descriptor = tok[:2]
+			tok = tok[2:]
+		}
+	}
+	if len(tok)%2 != 0 {
+		return "", "", nil, false
+	}
+	codes := make([]string, 0)
+	for i := 0; i < len(tok); i += 2 {
+		if _, err := weatherPhenomenaCodec.Code(tok[i : i+2]); err != nil {
+			return "", "", nil, false
+		}
+		codes = append(codes, tok[i:i+2])
+	}
+	if len(descriptor) == 0 && len(codes) == 0 {
+		return "", "", nil, false
+	}
+	return intensity, descriptor, codes, true
+}
+
+func weatherPhenomenaBits() int {
+	return weatherIntensityCodec.Bits + weatherDescriptorCodec.Bits + WEATHER_PHENOMENA_MAX_CODES*weatherPhenomenaCodec.Bits
+}
+
+// WeatherPhenomena is one present weather group, e.g. "+TSRA", "FZFG", "VCSH". Packed as its
+// intensity, descriptor, then WEATHER_PHENOMENA_MAX_CODES phenomena codes, unused ones zero.
+// Pack returns nil if the group can't be parsed.
+func (w WeatherPhenomena) Pack() []int {
+	intensity, descriptor, codes, ok := splitWeatherPhenomena(string(w))
+	if !ok || len(codes) > WEATHER_PHENOMENA_MAX_CODES {
+		return nil
+	}
+	ret, _ := weatherIntensityCodec.Encode(intensity)
+	b, _ := weatherDescriptorCodec.Encode(descriptor)
+	ret = append(ret, b...)
+	for i := 0; i < WEATHER_PHENOMENA_MAX_CODES; i++ {
+		code := ""
+		if i < len(codes) {
+			code = codes[i]
+		}
+		b, _ = weatherPhenomenaCodec.Encode(code)
+		ret = append(ret, b...)
+	}
+	return ret
+}
+
+func (w *WeatherPhenomena) Unpack(data []int) error {
+	if len(data) != weatherPhenomenaBits() {
+		return errors.New("Invalid length.")
+	}
+	intensity, err := weatherIntensityCodec.Decode(data[:weatherIntensityCodec.Bits])
+	if err != nil {
+		return err
+	}
+	data = data[weatherIntensityCodec.Bits:]
+	descriptor, err := weatherDescriptorCodec.Decode(data[:weatherDescriptorCodec.Bits])
+	if err != nil {
+		return err
+	}
+	data = data[weatherDescriptorCodec.Bits:]
+
+	tok := intensity.Keywords[0] + descriptor.Keywords[0]
+	end := false
+	for i := 0; i < WEATHER_PHENOMENA_MAX_CODES; i++ {
+		code, err := weatherPhenomenaCodec.Decode(data[i*weatherPhenomenaCodec.Bits : (i+1)*weatherPhenomenaCodec.Bits])
+		if err != nil {
+			return err
+		}
+		if len(code.Keywords[0]) == 0 {
+			end = true
+		} else if end {
+			return errors.New("Phenomena code after an empty code.")
+		}
+		tok += code.Keywords[0]
+	}
+	if _, _, _, ok := splitWeatherPhenomena(tok); !ok {
+		return fmt.Errorf("Invalid weather group '%s'.", tok)
+	}
+	*w = WeatherPhenomena(tok)
+	return nil
+}
+
+func (w WeatherPhenomena) String() string {
+	return string(w)
+}
+
+// Bit widths of the fields in a struct passed to Marshal() and Unmarshal() come from a `weatherpack:"<bits>"` tag.
+// Without a tag, the width is taken from the length of the field's Pack() output. Fields tagged `weatherpack:"-"`
+// and unexported fields are skipped.
+
+type packField struct {
+	Name  string
+	Value reflect.Value
+	Bits  int // -1 if not given in a tag.
+}
+
+func structPackFields(v reflect.Value) ([]packField, error) {
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected a struct, got %s", v.Kind())
+	}
+	ret := make([]packField, 0)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if len(sf.PkgPath) > 0 {
+			continue // Unexported.
+		}
+		tag := sf.Tag.Get("weatherpack")
+		if tag == "-" {
+			continue
+		}
+		f := packField{Name: sf.Name, Value: v.Field(i), Bits: -1}
+		if len(tag) > 0 {
+			bits, err := strconv.Atoi(tag)
+			if err != nil || bits <= 0 {
+				return nil, fmt.Errorf("field %s: invalid weatherpack tag '%s'", sf.Name, tag)
+			}
+			f.Bits = bits
+		}
+		ret = append(ret, f)
+	}
+	return ret, nil
+}
+
+// bitsToBytes packs bits MSB first, padding the last byte with zeros.
+func bitsToBytes(bits []int) []byte {
+	ret := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		if b != 0 {
+			ret[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return ret
+}
+
+func bytesToBits(data []byte) []int {
+	ret := make([]int, len(data)*8)
+	for i := range ret {
+		ret[i] = int(data[i/8]>>uint(7-i%8)) & 1
+	}
+	return ret
+}
+
+/*
+	Unmarshal().
+	 Reverse of Marshal(). 'v' must be a pointer to a struct whose fields implement WeatherUnpacker
+	 (with a pointer receiver). The input must be exactly as long as the fields require, with zero padding.
+*/
+
 func Unmarshal(data []byte, v interface{}) error {
-	//TODO.
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("Unmarshal(): Need a non-nil pointer to a struct.")
+	}
+	fields, err := structPackFields(rv.Elem())
+	if err != nil {
+		return fmt.Errorf("Unmarshal(): %s.", err.Error())
+	}
+
+	bits := bytesToBits(data)
+	pos := 0
+	for _, f := range fields {
+		unpacker, ok := f.Value.Addr().Interface().(WeatherUnpacker)
+		if !ok {
+			return fmt.Errorf("Unmarshal(): Field %s does not implement WeatherUnpacker.", f.Name)
+		}
+		width := f.Bits
+		if width < 0 {
+			packer, ok := f.Value.Interface().(WeatherPacker)
+			if !ok {
+				return fmt.Errorf("Unmarshal(): Field %s has no weatherpack tag and does not implement WeatherPacker.", f.Name)
+			}
+			width = len(packer.Pack())
+		}
+		if pos+width > len(bits) {
+			return fmt.Errorf("Unmarshal(): Short input: field %s needs bits %d-%d, only %d bits available.", f.Name, pos, pos+width-1, len(bits))
+		}
+		if err := unpacker.Unpack(bits[pos : pos+width]); err != nil {
+			return fmt.Errorf("Unmarshal(): Field %s: %s", f.Name, err.Error())
+		}
+		pos += width
+	}
+
+	// Only zero padding is allowed after the last field.
+	if len(data) != (pos+7)/8 {
+		return fmt.Errorf("Unmarshal(): Input is %d bytes, expected %d.", len(data), (pos+7)/8)
+	}
+	for i := pos; i < len(bits); i++ {
+		if bits[i] != 0 {
+			return fmt.Errorf("Unmarshal(): Non-zero padding bit %d.", i)
+		}
+	}
+
 	return nil
 }
 
+/*
+	Marshal().
+	 Concatenates the Pack() output of each field of the struct 'v' (or pointer to it), in field order,
+	 and packs the bits MSB first into bytes.
+*/
+
 func Marshal(v interface{}) ([]byte, error) {
-	//TODO.
-	return []byte{}, nil
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, errors.New("Marshal(): Nil pointer.")
+		}
+		rv = rv.Elem()
+	}
+	fields, err := structPackFields(rv)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal(): %s.", err.Error())
+	}
+
+	bits := make([]int, 0)
+	for _, f := range fields {
+		packer, ok := f.Value.Interface().(WeatherPacker)
+		if !ok {
+			return nil, fmt.Errorf("Marshal(): Field %s does not implement WeatherPacker.", f.Name)
+		}
+		b := packer.Pack()
+		if f.Bits >= 0 && len(b) != f.Bits {
+			return nil, fmt.Errorf("Marshal(): Field %s packed to %d bits, tag says %d.", f.Name, len(b), f.Bits)
+		}
+		for i, bit := range b {
+			if bit != 0 && bit != 1 {
+				return nil, fmt.Errorf("Marshal(): Field %s: invalid bit value %d at %d.", f.Name, bit, i)
+			}
+		}
+		bits = append(bits, b...)
+	}
+
+	return bitsToBytes(bits), nil
 }
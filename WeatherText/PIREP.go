@@ -0,0 +1,79 @@
+package WeatherText
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PIREP_ALTITUDE_UNKNOWN = -1
+)
+
+type PIREP struct {
+	Urgent   bool              // UUA rather than UA.
+	Time     time.Time         // From the /TM field. Zero if not present.
+	Altitude int               // Feet MSL from the /FL field, or PIREP_ALTITUDE_UNKNOWN.
+	Fields   map[string]string // Field identifier ("OV", "TM", "FL", "TP", "TB", ...) -> value.
+}
+
+/*
+	ParsePIREP().
+	 Parses raw PIREP text like:
+	  DTW UUA /OV DTW090010/TM 1815/FL080/TP B737/TB SEV
+	 The /TM time is resolved to the most recent matching time before 'now'.
+*/
+
+func ParsePIREP(text string, now time.Time) (*PIREP, error) {
+	x := strings.Split(text, "/")
+	if len(x) < 2 {
+		return nil, errors.New("ParsePIREP(): No fields in report.")
+	}
+
+	ret := new(PIREP)
+	ret.Altitude = PIREP_ALTITUDE_UNKNOWN
+	ret.Fields = make(map[string]string, 0)
+
+	// Report type comes before the first field, optionally after the reporting station.
+	header := strings.Fields(x[0])
+	switch {
+	case len(header) > 0 && header[len(header)-1] == "UUA":
+		ret.Urgent = true
+	case len(header) > 0 && header[len(header)-1] == "UA":
+		ret.Urgent = false
+	default:
+		return nil, fmt.Errorf("ParsePIREP(): Unknown report type '%s'.", strings.TrimSpace(x[0]))
+	}
+
+	for _, f := range x[1:] {
+		f = strings.TrimSpace(f)
+		if len(f) < 2 {
+			continue
+		}
+		ret.Fields[f[:2]] = strings.TrimSpace(f[2:])
+	}
+
+	if tm, ok := ret.Fields["TM"]; ok && len(tm) >= 4 {
+		h, err1 := strconv.Atoi(tm[:2])
+		m, err2 := strconv.Atoi(tm[2:4])
+		if err1 == nil && err2 == nil && h < 24 && m < 60 {
+			now = now.UTC()
+			t := time.Date(now.Year(), now.Month(), now.Day(), h, m, 0, 0, time.UTC)
+			if t.After(now) {
+				t = t.Add(-24 * time.Hour) // Reported yesterday.
+			}
+			ret.Time = t
+		}
+	}
+
+	if fl, ok := ret.Fields["FL"]; ok && len(fl) >= 3 {
+		// Flight level in hundreds of feet, e.g. "080". "UNKN", "DURC", "DURD" are left as unknown.
+		if alt, err := strconv.Atoi(fl[:3]); err == nil {
+			ret.Altitude = alt * 100
+		}
+	}
+
+	return ret, nil
+}
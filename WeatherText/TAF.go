@@ -0,0 +1,256 @@
+package WeatherText
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TAF change group types.
+const (
+	TAF_GROUP_BASE  = iota // Initial forecast conditions, before any change group.
+	TAF_GROUP_FM           // FMddhhmm - conditions change completely at the given time.
+	TAF_GROUP_BECMG        // BECMG ddhh/ddhh - gradual change, lasting until the next FM group.
+	TAF_GROUP_TEMPO        // TEMPO ddhh/ddhh - temporary fluctuations within the period.
+	TAF_GROUP_PROB         // PROBnn [TEMPO] ddhh/ddhh - probability of conditions within the period.
+)
+
+type TAFGroup struct {
+	Type   int
+	From   time.Time
+	To     time.Time
+	Tokens []string // Full group, including the change indicator and period.
+}
+
+type TAF struct {
+	StationID string
+	Modifiers []string // "AMD", "COR".
+	IssueTime string   // Original ddhhmmZ token, if present.
+	ValidFrom time.Time
+	ValidTo   time.Time
+	Groups    []TAFGroup
+}
+
+/*
+	ParseTAF().
+	 Parses raw TAF text like:
+	  TAF KDTW 181720Z 1818/1924 22012G20KT P6SM SCT050 FM182200 24010KT P6SM BKN050 TEMPO 1900/1904 3SM -SHRA BKN030
+	 The day/hour times in the TAF are resolved to the month closest to 'now'. Remarks are dropped.
+*/
+
+func ParseTAF(text string, now time.Time) (*TAF, error) {
+	tokens := strings.Fields(strings.Replace(text, "=", " ", -1))
+	ret := new(TAF)
+
+	i := 0
+	if i < len(tokens) && tokens[i] == "TAF" {
+		i++
+	}
+	for i < len(tokens) && (tokens[i] == "AMD" || tokens[i] == "COR") {
+		ret.Modifiers = append(ret.Modifiers, tokens[i])
+		i++
+	}
+	if i >= len(tokens) || len(tokens[i]) != 4 {
+		return nil, errors.New("ParseTAF(): Missing station identifier.")
+	}
+	ret.StationID = tokens[i]
+	i++
+
+	if i < len(tokens) && len(tokens[i]) == 7 && strings.HasSuffix(tokens[i], "Z") {
+		ret.IssueTime = tokens[i]
+		i++
+	}
+
+	if i >= len(tokens) {
+		return nil, errors.New("ParseTAF(): Missing valid period.")
+	}
+	from, to, err := parseTAFPeriod(tokens[i], now)
+	if err != nil {
+		return nil, err
+	}
+	ret.ValidFrom, ret.ValidTo = from, to
+	i++
+
+	// Split the rest into change groups.
+	group := TAFGroup{Type: TAF_GROUP_BASE, From: ret.ValidFrom, To: ret.ValidTo}
+	for i < len(tokens) {
+		tok := tokens[i]
+		if tok == "RMK" {
+			break // Remarks aren't broadcast.
+		}
+
+		var next *TAFGroup
+		switch {
+		case strings.HasPrefix(tok, "FM") && len(tok) == 8:
+			t, err := parseTAFDayTime(tok[2:4], tok[4:6], tok[6:8], now)
+			if err != nil {
+				return nil, err
+			}
+			next = &TAFGroup{Type: TAF_GROUP_FM, From: t, To: ret.ValidTo, Tokens: []string{tok}}
+			i++
+		case tok == "BECMG" || tok == "TEMPO" || strings.HasPrefix(tok, "PROB"):
+			next = &TAFGroup{Tokens: []string{tok}}
+			switch tok {
+			case "BECMG":
+				next.Type = TAF_GROUP_BECMG
+			case "TEMPO":
+				next.Type = TAF_GROUP_TEMPO
+			default:
+				next.Type = TAF_GROUP_PROB
+			}
+			i++
+			if next.Type == TAF_GROUP_PROB && i < len(tokens) && tokens[i] == "TEMPO" {
+				next.Tokens = append(next.Tokens, tokens[i])
+				i++
+			}
+			if i >= len(tokens) {
+				return nil, fmt.Errorf("ParseTAF(): Missing period for %s group.", tok)
+			}
+			next.From, next.To, err = parseTAFPeriod(tokens[i], now)
+			if err != nil {
+				return nil, err
+			}
+			next.Tokens = append(next.Tokens, tokens[i])
+			i++
+		default:
+			group.Tokens = append(group.Tokens, tok)
+			i++
+			continue
+		}
+
+		ret.Groups = append(ret.Groups, group)
+		group = *next
+	}
+	ret.Groups = append(ret.Groups, group)
+
+	// Base and FM groups last until the next FM group.
+	lastFM := -1
+	for j := range ret.Groups {
+		if ret.Groups[j].Type == TAF_GROUP_FM || ret.Groups[j].Type == TAF_GROUP_BASE {
+			if lastFM >= 0 {
+				ret.Groups[lastFM].To = ret.Groups[j].From
+			}
+			lastFM = j
+		}
+	}
+
+	return ret, nil
+}
+
+/*
+	Compact().
+	 Returns the TAF as text with groups that no longer apply at 'now' removed:
+	  Base and FM groups that have been superseded by a later FM group, along with their BECMG groups.
+	  TEMPO and PROB groups whose period has ended.
+	 Only the station, valid period and groups are kept - the "TAF" prefix, AMD/COR, the issuance
+	 time and remarks are dropped. Tokens are shortened by compactTAFToken(), e.g.:
+	  TAF AMD KDTW 181720Z 1818/1924 22012G20KT P6SM SCT050 -> KDTW 1818/1924 22012G20 P6 SCT050
+*/
+
+func (t *TAF) Compact(now time.Time) string {
+	ret := make([]string, 0)
+	ret = append(ret, t.StationID)
+	ret = append(ret, formatTAFPeriod(t.ValidFrom, t.ValidTo))
+
+	segmentExpired := false // Whether the current base/FM group has been superseded.
+	for _, g := range t.Groups {
+		switch g.Type {
+		case TAF_GROUP_BASE, TAF_GROUP_FM:
+			segmentExpired = !g.To.After(now)
+			if segmentExpired {
+				continue
+			}
+		case TAF_GROUP_BECMG:
+			if segmentExpired {
+				continue
+			}
+		case TAF_GROUP_TEMPO, TAF_GROUP_PROB:
+			if segmentExpired || !g.To.After(now) {
+				continue
+			}
+		}
+		for _, tok := range g.Tokens {
+			ret = append(ret, compactTAFToken(tok))
+		}
+	}
+	return strings.Join(ret, " ")
+}
+
+// compactTAFToken shortens "P6SM" to "P6" and drops "KT" from wind groups, e.g. "22012G20KT" -> "22012G20".
+// Winds in MPS keep their unit.
+func compactTAFToken(tok string) string {
+	if tok == "P6SM" {
+		return "P6"
+	}
+	if len(tok) >= 7 && strings.HasSuffix(tok, "KT") {
+		wind := strings.TrimSuffix(tok, "KT")
+		dir, speeds := wind[:3], wind[3:]
+		if _, err := strconv.Atoi(dir); err != nil && dir != "VRB" {
+			return tok
+		}
+		for _, c := range speeds {
+			if (c < '0' || c > '9') && c != 'G' {
+				return tok
+			}
+		}
+		return wind
+	}
+	return tok
+}
+
+// parseTAFPeriod parses "ddhh/ddhh".
+func parseTAFPeriod(s string, now time.Time) (from, to time.Time, err error) {
+	if len(s) != 9 || s[4] != '/' {
+		err = fmt.Errorf("parseTAFPeriod(): Invalid period '%s'.", s)
+		return
+	}
+	from, err = parseTAFDayTime(s[0:2], s[2:4], "00", now)
+	if err != nil {
+		return
+	}
+	to, err = parseTAFDayTime(s[5:7], s[7:9], "00", now)
+	return
+}
+
+func formatTAFPeriod(from, to time.Time) string {
+	// An end time of midnight is written as hour 24 of the previous day.
+	toDay, toHour := to.Day(), to.Hour()
+	if toHour == 0 {
+		prev := to.Add(-1 * time.Hour)
+		toDay, toHour = prev.Day(), 24
+	}
+	return fmt.Sprintf("%02d%02d/%02d%02d", from.Day(), from.Hour(), toDay, toHour)
+}
+
+// parseTAFDayTime resolves a day of month and time to the nearest matching date to 'now'.
+func parseTAFDayTime(day, hour, minute string, now time.Time) (time.Time, error) {
+	d, err1 := strconv.Atoi(day)
+	h, err2 := strconv.Atoi(hour)
+	m, err3 := strconv.Atoi(minute)
+	if err1 != nil || err2 != nil || err3 != nil || d < 1 || d > 31 || h > 24 || m > 59 {
+		return time.Time{}, fmt.Errorf("parseTAFDayTime(): Invalid time '%s%s%s'.", day, hour, minute)
+	}
+
+	now = now.UTC()
+	var ret time.Time
+	for _, monthOffset := range []int{-1, 0, 1} {
+		t := time.Date(now.Year(), now.Month()+time.Month(monthOffset), d, 0, m, 0, 0, time.UTC)
+		if t.Day() != d {
+			continue // Day doesn't exist in this month.
+		}
+		t = t.Add(time.Duration(h) * time.Hour) // Hour 24 rolls over to the next day.
+		if ret.IsZero() || absDuration(t.Sub(now)) < absDuration(ret.Sub(now)) {
+			ret = t
+		}
+	}
+	return ret, nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
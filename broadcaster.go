@@ -1,22 +1,35 @@
 package main
 
 import (
+	"./LoRaPacket"
+	"./Radar"
+	"./WeatherPack"
+	"./WeatherText"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/cyoung/ADDS"
-	//	"github.com/cyoung/NEXRAD"
+	"github.com/cyoung/NEXRAD"
 	"github.com/kellydunn/golang-geo"
 	"github.com/stratux/goRFM95W/goRFM95W"
+	"hash/crc32"
+	"net/http"
 	"os"
 	"sort"
-	//	"strconv"
 	"time"
 )
 
 type Config struct {
-	StationLat          float64
-	StationLng          float64
-	StationServiceRange uint // Statute miles.
+	StationLat                 float64
+	StationLng                 float64
+	StationServiceRange        uint    // Statute miles.
+	PIREPMinAltitude           int     // Feet MSL. PIREPs reported below this altitude are not broadcast.
+	PIREPMaxAltitude           int     // Feet MSL. PIREPs reported above this altitude are not broadcast. 0 = no limit.
+	PIREPAltitudeUnknownInBand bool    // Broadcast PIREPs that report no altitude regardless of PIREPMinAltitude/PIREPMaxAltitude. If false they are dropped whenever a band is set.
+	PIREPMaxAge                uint    // Minutes. PIREPs older than this are not broadcast. 0 = no limit.
+	RadarTileSpan              float64 // Degrees covered by each NEXRAD tile.
+	RadarProductURL            string  // The NEXRAD mosaic the tiles are cut from. Its Last-Modified header is the scan time. Radar is not broadcast if empty.
+	PackMETARs                 bool    // Send METARs packed with WeatherPack instead of as text.
 }
 
 const (
@@ -34,7 +47,6 @@ func weatherUpdater() {
 	updateTicker := time.NewTicker(5 * time.Minute)
 	for {
 		// Update the weather.
-		//TODO: Need to add type-specific formatting that the correct meta-data for the report (lat/lng for PIREP, actually form coherent radar frames, etc.)
 		// Get METARs.
 		addsMetars, err := ADDS.GetLatestADDSMETARsInRadiusOf(myConfig.StationServiceRange, selfGeo)
 		if err != nil {
@@ -43,71 +55,199 @@ func weatherUpdater() {
 			for _, metar := range addsMetars {
 				// Generate a message, send it.
 				m := DataMessage{
+					Type:     LoRaPacket.FRAME_TYPE_METAR,
 					Message:  []byte(metar.Text),
 					UniqID:   "METAR " + metar.StationID,
 					Priority: 10,
 					Expiry:   time.Now().Add(15 * time.Minute),
 				}
+				if myConfig.PackMETARs {
+					// Fall back to text if the METAR can't be packed.
+					parsedMetar, err := WeatherPack.ParseMETAR(metar.Text)
+					if err != nil {
+						fmt.Printf("error parsing METAR '%s': %s\n", metar.Text, err.Error())
+					} else if packed, err := WeatherPack.PackMETAR(parsedMetar); err != nil {
+						fmt.Printf("error packing METAR '%s': %s\n", metar.Text, err.Error())
+					} else {
+						m.Type = LoRaPacket.FRAME_TYPE_METAR_PACKED
+						m.Message = packed
+					}
+				}
 				messageChan <- m
 			}
 		}
-		//FIXME: Only supporting METARs at the moment.
-		/*
-			// Get TAFs.
-			addsTafs, err := ADDS.GetLatestADDSTAFsInRadiusOf(myConfig.StationServiceRange, selfGeo)
-			if err != nil {
-				fmt.Printf("error obtaining TAFs: %s\n", err.Error())
-			} else {
-				for _, taf := range addsTafs {
-					// Generate a message, send it.
-					m := DataMessage{
-						Message:  []byte(taf.Text),
-						UniqID:   "TAF " + taf.StationID,
-						Priority: 11,
-						Expiry:   time.Now().Add(15 * time.Minute),
-					}
-					messageChan <- m
+		// Get TAFs.
+		addsTafs, err := ADDS.GetLatestADDSTAFsInRadiusOf(myConfig.StationServiceRange, selfGeo)
+		if err != nil {
+			fmt.Printf("error obtaining TAFs: %s\n", err.Error())
+		} else {
+			t := time.Now()
+			for _, taf := range addsTafs {
+				// Drop the change groups that no longer apply so the TAF fits in fewer packets.
+				parsedTaf, err := WeatherText.ParseTAF(taf.Text, t)
+				if err != nil {
+					fmt.Printf("error parsing TAF for %s: %s\n", taf.StationID, err.Error())
+					continue
 				}
+				if !parsedTaf.ValidTo.After(t) {
+					continue // Already expired.
+				}
+				// Generate a message, send it.
+				m := DataMessage{
+					Type:     LoRaPacket.FRAME_TYPE_TAF,
+					Message:  []byte(parsedTaf.Compact(t)),
+					UniqID:   "TAF " + taf.StationID,
+					Priority: 11,
+					Expiry:   parsedTaf.ValidTo,
+				}
+				messageChan <- m
 			}
-			// Get PIREPs.
-			addsPireps, err := ADDS.GetLatestADDSPIREPsInRadiusOf(myConfig.StationServiceRange, selfGeo)
-			if err != nil {
-				fmt.Printf("error obtaining PIREPs: %s\n", err.Error())
-			} else {
-				for _, pirep := range addsPireps {
-					// Generate a message, send it.
-					m := DataMessage{
-						Message:  []byte(pirep.Text),
-						UniqID:   "PIREP " + strconv.FormatFloat(pirep.Latitude, 'f', 5, 64) + "," + strconv.FormatFloat(pirep.Longitude, 'f', 5, 64),
-						Priority: 9,
-						Expiry:   time.Now().Add(15 * time.Minute),
+		}
+		// Get PIREPs.
+		addsPireps, err := ADDS.GetLatestADDSPIREPsInRadiusOf(myConfig.StationServiceRange, selfGeo)
+		if err != nil {
+			fmt.Printf("error obtaining PIREPs: %s\n", err.Error())
+		} else {
+			t := time.Now()
+			for _, pirep := range addsPireps {
+				parsedPirep, err := WeatherText.ParsePIREP(pirep.Text, t)
+				if err != nil {
+					fmt.Printf("error parsing PIREP '%s': %s\n", pirep.Text, err.Error())
+					continue
+				}
+				// Altitude band.
+				altitudeUnknown := parsedPirep.Altitude == WeatherText.PIREP_ALTITUDE_UNKNOWN
+				if altitudeUnknown {
+					if !myConfig.PIREPAltitudeUnknownInBand && (myConfig.PIREPMinAltitude > 0 || myConfig.PIREPMaxAltitude > 0) {
+						continue
 					}
-					messageChan <- m
+				} else if parsedPirep.Altitude < myConfig.PIREPMinAltitude || (myConfig.PIREPMaxAltitude > 0 && parsedPirep.Altitude > myConfig.PIREPMaxAltitude) {
+					continue
+				}
+				// Age limit. The PIREP expires once it reaches the limit.
+				expiry := t.Add(15 * time.Minute)
+				if myConfig.PIREPMaxAge > 0 && !parsedPirep.Time.IsZero() {
+					expiry = parsedPirep.Time.Add(time.Duration(myConfig.PIREPMaxAge) * time.Minute)
+					if !expiry.After(t) {
+						continue
+					}
+				}
+				// Urgent PIREPs go out ahead of everything else.
+				priority := 9
+				if parsedPirep.Urgent {
+					priority = 1
+				}
+				// Generate a message, send it. The position goes in the frame header, so the UniqID only needs to tell reports apart.
+				m := DataMessage{
+					Type:     LoRaPacket.FRAME_TYPE_PIREP,
+					Message:  []byte(pirep.Text),
+					UniqID:   fmt.Sprintf("PIREP %08x", crc32.ChecksumIEEE([]byte(pirep.Text))),
+					Priority: priority,
+					Expiry:   expiry,
+					Position: &LoRaPacket.Position{
+						Lat:             pirep.Latitude,
+						Lng:             pirep.Longitude,
+						Altitude:        parsedPirep.Altitude,
+						AltitudeUnknown: altitudeUnknown,
+					},
 				}
+				messageChan <- m
 			}
-			// Get NEXRAD.
-			t, err := NEXRAD.GetCompressedTileFromLatLng(myConfig.StationLat, myConfig.StationLng)
+		}
+		// Get NEXRAD. All tiles of the mosaic are queued together with the same FrameID.
+		if len(myConfig.RadarProductURL) > 0 {
+			frameSet, err := Radar.BuildFrameSet(myConfig.StationLat, myConfig.StationLng, myConfig.StationServiceRange, myConfig.RadarTileSpan, fetchNEXRADTile)
 			if err != nil {
 				fmt.Printf("error obtaining NEXRAD: %s\n", err.Error())
 			} else {
-				m := DataMessage{
-					Message:  t,
-					UniqID:   "NEXRAD",
-					Priority: 12,
-					Expiry:   time.Now().Add(15 * time.Minute),
+				for _, tile := range frameSet.Tiles {
+					m := DataMessage{
+						Type:     LoRaPacket.FRAME_TYPE_NEXRAD,
+						Message:  tile.Marshal(),
+						UniqID:   fmt.Sprintf("NEXRAD %d,%d", tile.Row, tile.Col),
+						Priority: 12,
+						Expiry:   frameSet.Time.Add(15 * time.Minute),
+					}
+					messageChan <- m
 				}
-				messageChan <- m
 			}
-		*/
+		}
 		<-updateTicker.C
 	}
 }
 
+// nexradProductTime returns the Last-Modified time of RadarProductURL, the time of the scan currently served.
+func nexradProductTime() (time.Time, error) {
+	resp, err := http.Head(myConfig.RadarProductURL)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("nexradProductTime(): %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("nexradProductTime(): %s answered %d.", myConfig.RadarProductURL, resp.StatusCode)
+	}
+	t, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("nexradProductTime(): No Last-Modified time from %s.", myConfig.RadarProductURL)
+	}
+	return t.UTC(), nil
+}
+
+/*
+	fetchNEXRADTile().
+	 Radar.TileFetcher for the NEXRAD mosaic. The library doesn't report the scan time, so it is
+	 read from the product before and after the tile is fetched. If the product changed in between
+	 the tile may be from either scan and the fetch fails. Radar.BuildFrameSet() rejects the set if
+	 its tiles come from different scans.
+*/
+
+func fetchNEXRADTile(lat, lng float64) ([]byte, time.Time, error) {
+	scanTime, err := nexradProductTime()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := NEXRAD.GetCompressedTileFromLatLng(lat, lng)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	after, err := nexradProductTime()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !after.Equal(scanTime) {
+		return nil, time.Time{}, fmt.Errorf("fetchNEXRADTile(): Product was updated during the fetch (%s -> %s).", scanTime, after)
+	}
+	return data, scanTime, nil
+}
+
 type DataMessage struct {
+	Type     uint8 // LoRaPacket.FRAME_TYPE_*.
 	Message  []byte
-	UniqID   string    // Identifier for the message. If another message is received with this same identifier, the new message replaces it.
-	Priority int       // Priority is a non-unique. All messages of a single priority are grouped together, unordered.
-	Expiry   time.Time // The message expires after this timestamp. It will not be sent after the maintenance period has passed and the sendList has been sent completely at least once.
+	UniqID   string               // Identifier for the message. If another message is received with this same identifier, the new message replaces it.
+	Priority int                  // Priority is a non-unique. All messages of a single priority are grouped together, unordered.
+	Expiry   time.Time            // The message expires after this timestamp. It will not be sent after the maintenance period has passed and the sendList has been sent completely at least once.
+	Position *LoRaPacket.Position // Optional. Sent in the frame header.
+	msgID    uint16               // Fragment MessageID. Assigned by messageQueuer(), changes when the contents for UniqID change.
+}
+
+// marshalFrame wraps the message in a LoRaPacket.Frame.
+func (msg DataMessage) marshalFrame() ([]byte, error) {
+	frame := LoRaPacket.Frame{
+		Type:     msg.Type,
+		UniqID:   msg.UniqID,
+		Expiry:   msg.Expiry,
+		Position: msg.Position,
+		Payload:  msg.Message,
+	}
+	return frame.Marshal()
+}
+
+// sameFrame returns true if 'a' and 'b' only differ in Expiry, which most sources recompute on every update.
+func sameFrame(a, b DataMessage) bool {
+	a.Expiry, b.Expiry = time.Time{}, time.Time{}
+	fa, errA := a.marshalFrame()
+	fb, errB := b.marshalFrame()
+	return errA == nil && errB == nil && bytes.Equal(fa, fb)
 }
 
 var messageQueue map[string]DataMessage // UniqID -> DataMessage mapping.
@@ -126,47 +266,38 @@ func cleanupMessageQueue() {
 
 /*
 	makeSendList().
-	 Orders the messageQueue by Priority, then creates chunks of size MAX_PACKET_SIZE.
+	 Orders the messageQueue by Priority, wraps each message in a LoRaPacket.Frame, then splits the frames into fragments and packs them into packets of size MAX_PACKET_SIZE.
 */
 
 func makeSendList() [][]byte {
-	ret := make([][]byte, 0)
-	priorities := make([]int, len(messageQueue))
-	var i int
-	sendListWithPriorities := make(map[int][][]byte, 0)
+	priorities := make([]int, 0)
+	sendListWithPriorities := make(map[int][]DataMessage, 0)
 	for _, msg := range messageQueue {
-		sendListWithPriorities[msg.Priority] = append(sendListWithPriorities[msg.Priority], msg.Message)
-		priorities[i] = msg.Priority
-		i++
+		if _, ok := sendListWithPriorities[msg.Priority]; !ok {
+			priorities = append(priorities, msg.Priority)
+		}
+		sendListWithPriorities[msg.Priority] = append(sendListWithPriorities[msg.Priority], msg)
 	}
 
-	// Start creating packets of size MAX_PACKET_SIZE.
+	// Frame and fragment the messages in priority order, then pack the fragments into packets of size MAX_PACKET_SIZE.
 	sort.Ints(priorities)
-	for i = 0; i < len(messageQueue); i++ {
-		if msgs, ok := sendListWithPriorities[priorities[i]]; ok {
-			for _, msg := range msgs {
-				if len(msg) > MAX_PACKET_SIZE {
-					//FIXME: Add provisions for fragmented packets.
-					//					fmt.Printf("WARNING! Message is larger than max packet size: '%s'\n", string(msg))
-					//					continue
-					for len(msg) > MAX_PACKET_SIZE {
-						ret = append(ret, msg[:MAX_PACKET_SIZE])
-						msg = msg[MAX_PACKET_SIZE+1:]
-					}
-					ret = append(ret, msg)
-				}
-				if len(ret) > 0 && (len(ret[len(ret)-1])+len(msg)+1) < MAX_PACKET_SIZE {
-					// Add this message to the last, with a '|' divider.
-					ret[len(ret)-1] = append(ret[len(ret)-1], byte('|'))
-					ret[len(ret)-1] = append(ret[len(ret)-1], msg...)
-				} else {
-					ret = append(ret, msg)
-				}
+	frags := make([]LoRaPacket.Fragment, 0)
+	for _, priority := range priorities {
+		for _, msg := range sendListWithPriorities[priority] {
+			b, err := msg.marshalFrame()
+			if err != nil {
+				fmt.Printf("WARNING! Can't frame message '%s': %s\n", msg.UniqID, err.Error())
+				continue
+			}
+			f, err := LoRaPacket.FragmentMessage(msg.msgID, msg.UniqID, b, MAX_PACKET_SIZE)
+			if err != nil {
+				fmt.Printf("WARNING! Can't fragment message '%s': %s\n", msg.UniqID, err.Error())
+				continue
 			}
-			delete(sendListWithPriorities, priorities[i]) // Remove this map key - we've finished with messages with this priority number.
+			frags = append(frags, f...)
 		}
 	}
-	return ret
+	return LoRaPacket.PackFragments(frags, MAX_PACKET_SIZE)
 }
 
 var messageChan chan DataMessage
@@ -177,6 +308,7 @@ func messageQueuer() {
 	var sendList [][]byte // Current message list.
 	var sendPosition int  // Position in the sending list.
 	var sendTimes int     // Number of times the current send list has been repeated.
+	var lastMsgID uint16  // Last fragment MessageID handed out.
 
 	packetSenderTicker := time.NewTicker(MAX_PACKET_TIME * time.Millisecond)
 	maintenanceTicker := time.NewTicker(10 * time.Second)
@@ -184,6 +316,14 @@ func messageQueuer() {
 		select {
 		case m := <-messageChan:
 			// Receive a message to include in the next transmission.
+			if old, ok := messageQueue[m.UniqID]; ok && sameFrame(old, m) {
+				// Same Type, UniqID, Position and Payload as before - keep the MessageID so receivers can ignore
+				// the repeats and keep reassembling a long message. Any other change gets a new MessageID.
+				m.msgID = old.msgID
+			} else {
+				lastMsgID++
+				m.msgID = lastMsgID
+			}
 			messageQueue[m.UniqID] = m
 			fmt.Printf("Got message for '%s'!\n", m.UniqID)
 		case <-packetSenderTicker.C:
@@ -245,6 +385,9 @@ func main() {
 	}
 
 	selfGeo = geo.NewPoint(myConfig.StationLat, myConfig.StationLng)
+	if len(myConfig.RadarProductURL) == 0 {
+		fmt.Printf("warning: no RadarProductURL, NEXRAD is not broadcast.\n")
+	}
 
 	// Initialize LoRa module with default values.
 	rfm95w_h, err := goRFM95W.New(nil)
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"./RockBLOCK"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+/*
+	Runs a RockBLOCK.FakeCORE and sends one request to the weatherserver through it, then prints
+	the replies. Start weatherserver with ROCKBLOCK_CORE_URL=http://localhost:8081/rockblock/MT,
+	the same ROCKBLOCK_USER/ROCKBLOCK_PASS, and the test IMEI registered in its devices table.
+*/
+
+func main() {
+	listen := flag.String("listen", ":8081", "Address to serve the fake MT endpoint on.")
+	webhook := flag.String("webhook", "http://localhost:8080/receiveRockBLOCK", "weatherserver webhook.")
+	imei := flag.String("imei", "300234010000000", "Device IMEI.")
+	keyFile := flag.String("key", "", "PEM private key to sign MO posts with. Unsigned if empty.")
+	requestType := flag.Int("type", RockBLOCK.REQUEST_METAR, "Request type.")
+	data := flag.String("data", "KDTW", "Request data.")
+	lat := flag.Float64("lat", 42.2125, "Latitude.")
+	lng := flag.Float64("lng", -83.3534, "Longitude.")
+	wait := flag.Duration("wait", 1*time.Minute, "How long to wait for replies.")
+	momsnFlag := flag.Int("momsn", -1, "MOMSN of the request. Taken from the clock if negative, so the weatherserver doesn't take a second run for a replay.")
+	flag.Parse()
+
+	var c RockBLOCK.Config
+	c.ApplyEnv()
+	if len(c.COREUser) == 0 {
+		c.COREUser, c.COREPass = "test", "test"
+	}
+
+	f := RockBLOCK.NewFakeCORE(c.COREUser, c.COREPass)
+	f.WebhookURL = *webhook
+	f.AddDevice(*imei)
+	if *momsnFlag < 0 {
+		*momsnFlag = int(time.Now().Unix())
+	}
+	f.SetMOMSN(*imei, *momsnFlag)
+	if len(*keyFile) > 0 {
+		keyPEM, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			fmt.Printf("key error: %s\n", err.Error())
+			return
+		}
+		f.JWTKey, err = RockBLOCK.ParsePrivateKey(keyPEM)
+		if err != nil {
+			fmt.Printf("key error: %s\n", err.Error())
+			return
+		}
+	}
+	go func() {
+		if err := http.ListenAndServe(*listen, f); err != nil {
+			fmt.Printf("ListenAndServe: %s\n", err.Error())
+		}
+	}()
+
+	req := RockBLOCK.IridiumMessage{
+		LatLngPresent: true,
+		Lat:           *lat,
+		Lng:           *lng,
+		RequestType:   *requestType,
+		Time:          time.Now(),
+		Data:          []byte(*data),
+	}
+	msg, err := req.Marshal()
+	if err != nil {
+		fmt.Printf("message error: %s\n", err.Error())
+		return
+	}
+	momsn, status, err := f.SendMO(*imei, msg, *lat, *lng)
+	if err != nil {
+		fmt.Printf("MO error: %s\n", err.Error())
+		return
+	}
+	fmt.Printf("MOMSN %d: webhook answered %d\n", momsn, status)
+
+	seen := 0
+	deadline := time.Now().Add(*wait)
+	for time.Now().Before(deadline) {
+		sent := f.Sent()
+		for _, m := range sent[seen:] {
+			fmt.Printf("MT %s to %s (%d bytes): %q\n", m.MessageID, m.IMEI, len(m.Data), m.Data)
+		}
+		seen = len(sent)
+		time.Sleep(1 * time.Second)
+	}
+}
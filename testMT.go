@@ -6,8 +6,21 @@ import (
 )
 
 func main() {
+	// Credentials and device come from the environment.
+	var c RockBLOCK.Config
+	c.ApplyEnv()
+	if err := c.Validate(); err != nil {
+		fmt.Printf("config error: %s\n", err.Error())
+		return
+	}
+	if len(c.TestIMEI) == 0 {
+		fmt.Printf("config error: %s not set.\n", RockBLOCK.ENV_TEST_IMEI)
+		return
+	}
+	RockBLOCK.SetConfig(c)
+
 	m := new(RockBLOCK.RockBLOCKCOREOutgoing)
-	m.IMEI = RockBLOCK.TEST_IMEI
+	m.IMEI = c.TestIMEI
 	m.Data = []byte("HELLO!")
 	a, err := m.Send()
 	if err != nil {
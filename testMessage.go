@@ -3,6 +3,7 @@ package main
 import (
 	"./RockBLOCK"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/cyoung/ADDS"
 	"io/ioutil"
@@ -74,7 +75,11 @@ func situationGetter() {
 }
 
 func main() {
-	r, err := RockBLOCK.NewRockBLOCKSerial()
+	device := flag.String("device", RockBLOCK.SERIAL_DEFAULT_DEVICE, "Serial device.")
+	baud := flag.Int("baud", RockBLOCK.SERIAL_DEFAULT_BAUD, "Baud rate.")
+	flag.Parse()
+
+	r, err := RockBLOCK.NewRockBLOCKSerialWithOptions(RockBLOCK.SerialOptions{Device: *device, Baud: *baud})
 	if err != nil {
 		fmt.Printf("init error: %s\n", err.Error())
 		return
@@ -98,13 +103,21 @@ func main() {
 			fmt.Printf("%s\n", t)
 		}
 
-		tB, _ := t.MarshalText()
-		tS := string(tB)
-
-		msg := fmt.Sprintf("%s,%0.4f,%0.4f", tS, mySituation.Lat, mySituation.Lng)
-		fmt.Printf("msg=%s | len=%d. sending\n", msg, len(msg))
+		status := RockBLOCK.IridiumMessage{
+			LatLngPresent: true,
+			Lat:           float64(mySituation.Lat),
+			Lng:           float64(mySituation.Lng),
+			RequestType:   RockBLOCK.REQUEST_NIL,
+			Time:          t,
+		}
+		msg, err := status.Marshal()
+		if err != nil {
+			fmt.Printf("message error: %s\n", err.Error())
+			continue
+		}
+		fmt.Printf("msg=%x | len=%d. sending\n", msg, len(msg))
 
-		rb.SendBinaryPersistent([]byte(msg))
+		rb.SendBinaryPersistent(msg)
 
 	}
 
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"./RockBLOCK"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Exercises every RockBLOCKSerialConnection method against a RockBLOCK.Modem9602 over an
+	in-memory pipe. No device needed. Exits with status 1 if any check fails.
+*/
+
+var testOptions = RockBLOCK.SerialOptions{
+	CommandTimeout: 5 * time.Second,
+	NetworkPoll:    50 * time.Millisecond,
+}
+
+func connect() (*RockBLOCK.Modem9602, *RockBLOCK.RockBLOCKSerialConnection, error) {
+	m, t := RockBLOCK.NewModem9602Pipe()
+	r, err := RockBLOCK.NewRockBLOCKTransport(t, testOptions)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return m, r, nil
+}
+
+func testInit() error {
+	m, r, err := connect()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmds := m.Commands()
+	if len(cmds) != 2 || cmds[0] != "AT" || cmds[1] != "AT&K0" {
+		return fmt.Errorf("commands %q, expected AT, AT&K0.", cmds)
+	}
+	return nil
+}
+
+func testGetTime() error {
+	m, r, err := connect()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	m.Time = time.Date(2016, 8, 18, 17, 53, 0, 0, time.UTC)
+	t, err := r.GetTime()
+	if err != nil {
+		return err
+	}
+	if d := t.Sub(m.Time); d < -90*time.Millisecond || d > 90*time.Millisecond {
+		return fmt.Errorf("time %s, expected %s.", t, m.Time)
+	}
+	return nil
+}
+
+func testWaitForNetwork() error {
+	m, r, err := connect()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	m.SetSignalQuality(0)
+	if err := r.WaitForNetwork(300 * time.Millisecond); err == nil {
+		return errors.New("no signal, expected a timeout.")
+	}
+	m.SetSignalQuality(3)
+	if err := r.WaitForNetwork(1 * time.Second); err != nil {
+		return fmt.Errorf("signal 3: %s", err.Error())
+	}
+	if r.SignalQuality != 3 {
+		return fmt.Errorf("SignalQuality %d, expected 3.", r.SignalQuality)
+	}
+	return nil
+}
+
+func testSendText() error {
+	m, r, err := connect()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := r.SendText([]byte("METAR KDTW")); err != nil {
+		return err
+	}
+	sent := m.Sent()
+	if len(sent) != 1 || string(sent[0]) != "METAR KDTW" {
+		return fmt.Errorf("modem sent %q.", sent)
+	}
+	if r.SBDI.MOStatus != 1 || r.SBDI.MOMSN != 1 {
+		return fmt.Errorf("SBDI %+v.", r.SBDI)
+	}
+	return nil
+}
+
+func testSendBinary() error {
+	m, r, err := connect()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	req := RockBLOCK.IridiumMessage{LatLngPresent: true, Lat: 42.2125, Lng: -83.3534, RequestType: RockBLOCK.REQUEST_METAR, Data: []byte("KDTW")}
+	msg, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := r.SendBinary(msg); err != nil {
+		return err
+	}
+	sent := m.Sent()
+	if len(sent) != 1 || !bytes.Equal(sent[0], msg) {
+		return fmt.Errorf("modem sent %x, expected %x.", sent, msg)
+	}
+	return nil
+}
+
+func testSendFailure() error {
+	m, r, err := connect()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	m.FailSessions(1, RockBLOCK.SBDIX_MO_RF_DROP)
+	if err := r.SendBinary([]byte{1, 2, 3}); err == nil {
+		return errors.New("failed session, expected an error.")
+	}
+	if r.SBDI.MOStatus != 2 {
+		return fmt.Errorf("MOStatus %d, expected 2.", r.SBDI.MOStatus)
+	}
+	m.SetSignalQuality(0)
+	if err := r.SendText([]byte("x")); err == nil {
+		return errors.New("no signal, expected an error.")
+	}
+	if len(m.Sent()) != 0 {
+		return errors.New("modem sent a message from a failed session.")
+	}
+	return nil
+}
+
+// MT messages are downloaded after a session and passed to the message handler.
+func testReceive() error {
+	m, r, err := connect()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	received := make(chan []byte, 10)
+	r.SetMessageHandler(func(c RockBLOCK.RockBLOCKCallbackInfo) error {
+		if c.State == RockBLOCK.CALLBACK_RECV {
+			received <- c.Data
+		}
+		return nil
+	})
+	// Lengths 10 and 13 are '\n' and '\r' in the length header.
+	for _, mt := range [][]byte{[]byte("KDTW 181753Z 27010KT 10SM CLR 25/12 A3001"), []byte("0123456789"), {0x0a, 0x00, 0xff, 0x0d, 0x0d, 0x41, 0x0a, 0x0d, 0x0a, 0x42, 0x43, 0x44, 0x0a}} {
+		m.QueueMT(mt)
+		if err := r.SendText([]byte("PING")); err != nil {
+			return err
+		}
+		select {
+		case d := <-received:
+			if !bytes.Equal(d, mt) {
+				return fmt.Errorf("received %x, expected %x.", d, mt)
+			}
+		default:
+			return fmt.Errorf("MT %x not received.", mt)
+		}
+	}
+	return nil
+}
+
+func testSendBinaryPersistent() error {
+	m, r, err := connect()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	confirmed := make(chan []byte, 10)
+	r.SetMessageHandler(func(c RockBLOCK.RockBLOCKCallbackInfo) error {
+		if c.State == RockBLOCK.CALLBACK_CONFIRM_SENT {
+			confirmed <- c.Data
+		}
+		return nil
+	})
+	m.FailSessions(2, RockBLOCK.SBDIX_MO_BLOCKED)
+	r.SendBinaryPersistent([]byte("RETRY"))
+	select {
+	case d := <-confirmed:
+		if string(d) != "RETRY" {
+			return fmt.Errorf("confirmed %q.", d)
+		}
+	case <-time.After(10 * time.Second):
+		return errors.New("not confirmed.")
+	}
+	if sent := m.Sent(); len(sent) != 1 {
+		return fmt.Errorf("modem sent %d messages, expected 1.", len(sent))
+	}
+	return nil
+}
+
+// Counts the reads made by the driver.
+type countingTransport struct {
+	io.ReadWriteCloser
+	reads int64
+}
+
+func (c *countingTransport) Read(p []byte) (int, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.ReadWriteCloser.Read(p)
+}
+
+// With a ReadTimeout, the driver still stops reading a transport other than a serial port at EOF.
+func testReadTimeout() error {
+	m := RockBLOCK.NewModem9602()
+	a, b := net.Pipe()
+	go m.Serve(b)
+	t := &countingTransport{ReadWriteCloser: a}
+	opts := testOptions
+	opts.ReadTimeout = 100 * time.Millisecond
+	r, err := RockBLOCK.NewRockBLOCKTransport(t, opts)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	defer r.Close()
+	if _, err := r.GetTime(); err != nil {
+		return err
+	}
+	// The modem hangs up.
+	b.Close()
+	time.Sleep(200 * time.Millisecond)
+	n := atomic.LoadInt64(&t.reads)
+	time.Sleep(200 * time.Millisecond)
+	if d := atomic.LoadInt64(&t.reads) - n; d != 0 {
+		return fmt.Errorf("%d reads after EOF, expected 0.", d)
+	}
+	return nil
+}
+
+func testClose() error {
+	_, r, err := connect()
+	if err != nil {
+		return err
+	}
+	if err := r.Close(); err != nil {
+		return err
+	}
+	if _, err := r.GetTime(); err == nil {
+		return errors.New("GetTime() after Close(), expected an error.")
+	}
+	return nil
+}
+
+// The emulator's own answers: AT+SBDWB with a bad checksum and a bad length, and the +SBDIX failure codes.
+func testModem() error {
+	m, t := RockBLOCK.NewModem9602Pipe()
+	defer t.Close()
+	rd := bufio.NewReader(t)
+	// Reads the response up to 'want', then to the final "OK" (READY has none).
+	expect := func(want string) error {
+		var got []string
+		found := false
+		for {
+			l, err := rd.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			l = strings.TrimSpace(l)
+			got = append(got, l)
+			if l == want {
+				found = true
+			}
+			if found && (l == "OK" || l == "READY") {
+				return nil
+			}
+			if l == "OK" || l == "ERROR" {
+				return fmt.Errorf("got %q, expected %q.", got, want)
+			}
+		}
+	}
+
+	// Bad checksum.
+	fmt.Fprintf(t, "AT+SBDWB=3\r")
+	if err := expect("READY"); err != nil {
+		return err
+	}
+	t.Write([]byte{1, 2, 3, 0, 7})
+	if err := expect("2"); err != nil {
+		return fmt.Errorf("bad checksum: %s", err.Error())
+	}
+	// Bad length.
+	fmt.Fprintf(t, "AT+SBDWB=%d\r", RockBLOCK.MAX_MO_SZ+1)
+	if err := expect("3"); err != nil {
+		return fmt.Errorf("bad length: %s", err.Error())
+	}
+	// +SBDIX reports the failure code.
+	m.FailSessions(1, RockBLOCK.SBDIX_MO_NO_NETWORK)
+	fmt.Fprintf(t, "AT+SBDIX\r")
+	if err := expect("+SBDIX: 32, 0, 2, 0, 0, 0"); err != nil {
+		return err
+	}
+	fmt.Fprintf(t, "AT+SBDWT=HELLO\r")
+	if err := expect("OK"); err != nil {
+		return err
+	}
+	fmt.Fprintf(t, "AT+SBDIX\r")
+	if err := expect("+SBDIX: 0, 1, 0, 0, 0, 0"); err != nil {
+		return err
+	}
+	// Cleared by AT+SBDD0, nothing to send.
+	fmt.Fprintf(t, "AT+SBDD0\r")
+	if err := expect("OK"); err != nil {
+		return err
+	}
+	fmt.Fprintf(t, "AT+SBDI\r")
+	if err := expect("+SBDI: 0, 1, 0, 0, 0, 0"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func main() {
+	tests := []struct {
+		name string
+		f    func() error
+	}{
+		{"Init", testInit},
+		{"GetTime", testGetTime},
+		{"WaitForNetwork", testWaitForNetwork},
+		{"SendText", testSendText},
+		{"SendBinary", testSendBinary},
+		{"SendFailure", testSendFailure},
+		{"Receive", testReceive},
+		{"SendBinaryPersistent", testSendBinaryPersistent},
+		{"ReadTimeout", testReadTimeout},
+		{"Close", testClose},
+		{"Modem", testModem},
+	}
+
+	failed := 0
+	for _, t := range tests {
+		if err := t.f(); err != nil {
+			fmt.Printf("FAIL %s: %s\n", t.name, err.Error())
+			failed++
+		} else {
+			fmt.Printf("ok   %s\n", t.name)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d failed.\n", failed, len(tests))
+		os.Exit(1)
+	}
+}
@@ -1,19 +1,55 @@
 package main
 
 import (
- "fmt"
- "./WeatherPack"
- "time"
+	"./WeatherPack"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
 )
 
+// A group with more than 3 phenomena is split, not dropped, and survives PackMETAR().
+func checkWeatherGroups() error {
+	m, err := WeatherPack.ParseMETAR("KDTW 181753Z 27010KT 2SM +TSRAGRPLSN BR OVC010 25/22 A2992")
+	if err != nil {
+		return err
+	}
+	expected := []string{"+TSRAGRPL", "TSSN", "BR"}
+	if !reflect.DeepEqual(m.WeatherPhenomena, expected) {
+		return fmt.Errorf("ParseMETAR(): weather %q, expected %q.", m.WeatherPhenomena, expected)
+	}
+	b, err := WeatherPack.PackMETAR(m)
+	if err != nil {
+		return err
+	}
+	p, err := WeatherPack.UnpackMETAR(b)
+	if err != nil {
+		return err
+	}
+	if len(p.WeatherPhenomena) != len(expected) {
+		return fmt.Errorf("UnpackMETAR(): weather %q, expected %q.", p.WeatherPhenomena, expected)
+	}
+	for i, w := range p.WeatherPhenomena {
+		if w.String() != expected[i] {
+			return fmt.Errorf("UnpackMETAR(): weather %q, expected %q.", p.WeatherPhenomena, expected)
+		}
+	}
+	return nil
+}
+
 func main() {
-  p := WeatherPack.WeatherCollectionTime(time.Now())
-  fmt.Printf("%v\n", p.Encode())
+	p := WeatherPack.WeatherCollectionTime(time.Now())
+	fmt.Printf("%v\n", p.Pack())
 
- var t WeatherPack.WeatherCollectionTime
- t.Decode(p.Encode())
+	var t WeatherPack.WeatherCollectionTime
+	t.Unpack(p.Pack())
 
- fmt.Printf("%v\n", t)
- fmt.Printf("%s\n", t)
+	fmt.Printf("%v\n", t)
+	fmt.Printf("%s\n", t)
 
+	if err := checkWeatherGroups(); err != nil {
+		fmt.Printf("FAIL weather groups: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("ok   weather groups\n")
 }
@@ -2,17 +2,80 @@ package main
 
 import (
 	"../ADDS"
+	"./IridiumStore"
 	"./RockBLOCK"
-	"database/sql"
+	"./WeatherPack"
+	"./WeatherText"
+	"crypto/rsa"
+	"crypto/subtle"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/kellydunn/golang-geo"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-var db *sql.DB
+const (
+	PIREP_REQUEST_RADIUS        = 100 // Statute miles.
+	AIRPORTS_REQUEST_MAX        = 10
+	NEAREST_WEATHER_DEFAULT     = 5
+	NEAREST_WEATHER_MAX_LOOKUPS = 50 // Closest airports checked for a METAR.
+	ROUTE_WEATHER_DEFAULT_WIDTH = 25 // Statute miles either side of the route.
+	SEQUENCE_HEADER_MAX         = 8  // "nnn/nnn ".
+	LOG_QUERY_DEFAULT_LIMIT     = 1000
+	LOG_QUERY_MAX_LIMIT         = 10000
+	MOMSN_REPLAY_WINDOW         = 30 * 24 * time.Hour
+	MT_QUEUE_POLL               = 10 * time.Second
+	MT_RETRY_BASE               = 30 * time.Second // Wait before the first retry, doubled for each retry after that.
+	MT_RETRY_MAX                = 1 * time.Hour
+	MT_MAX_ATTEMPTS             = 10
+	MT_ERROR_MAX_LEN            = 255
+	ADMIN_TOKEN_MIN_LEN         = 16
+	WINDS_ALOFT_URL             = "https://aviationweather.gov/api/data/windtemp?region=all&level=low&fcst=06"
+)
+
+// Device reply formats.
+const (
+	REPLY_FORMAT_TEXT   = "text"   // Raw report text.
+	REPLY_FORMAT_PACKED = "packed" // WeatherPack where available.
+)
+
+// Environment variables that override ServerConfig values. RockBLOCK credentials use RockBLOCK.ENV_*.
+const (
+	ENV_DSN            = "WEATHERSERVER_DSN"
+	ENV_LISTEN_ADDRESS = "WEATHERSERVER_LISTEN"
+	ENV_TLS_CERT       = "WEATHERSERVER_TLS_CERT"
+	ENV_TLS_KEY        = "WEATHERSERVER_TLS_KEY"
+	ENV_JWT_KEY        = "WEATHERSERVER_JWT_KEY"
+	ENV_ALLOWED_IMEIS  = "WEATHERSERVER_ALLOWED_IMEIS" // Comma separated.
+	ENV_ADMIN_TOKEN    = "WEATHERSERVER_ADMIN_TOKEN"
+)
+
+type ServerConfig struct {
+	DSN           string // e.g. "user:pass@/iridium", or a file path with -db sqlite.
+	ListenAddress string // e.g. ":8080".
+	TLSCert       string // Certificate and key files. Plain HTTP if both are empty.
+	TLSKey        string
+	JWTPublicKey  string   // PEM file with the RockBLOCK public key. Webhook signatures are checked if set.
+	AllowedIMEIs  []string // Only these devices may post to the webhook. Empty = any registered device.
+	AdminToken    string   // Bearer token for the /log, /track/ and /mtqueue endpoints. They are disabled if empty.
+	RockBLOCK     RockBLOCK.Config
+}
+
+var myConfig ServerConfig
+
+var store IridiumStore.Store
+var jwtKey *rsa.PublicKey
+var airportDB *ADDS.AirportDB
+var dispatcher *RockBLOCK.Dispatcher
 
 // /metar/{IDENT}
 
@@ -29,6 +92,155 @@ func handleMETARRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// parseLogQuery reads the 'from' and 'to' (RFC 3339) and 'limit' URL parameters.
+func parseLogQuery(r *http.Request, imei string) (IridiumStore.LogQuery, error) {
+	q := IridiumStore.LogQuery{IMEI: imei, Limit: LOG_QUERY_DEFAULT_LIMIT}
+	v := r.URL.Query()
+	if s := v.Get("from"); len(s) > 0 {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, fmt.Errorf("Invalid 'from' time '%s'.", s)
+		}
+		q.From = t
+	}
+	if s := v.Get("to"); len(s) > 0 {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, fmt.Errorf("Invalid 'to' time '%s'.", s)
+		}
+		q.To = t
+	}
+	if s := v.Get("limit"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > LOG_QUERY_MAX_LIMIT {
+			return q, fmt.Errorf("Invalid 'limit', must be 1-%d.", LOG_QUERY_MAX_LIMIT)
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+/*
+	requireAdmin().
+	 Wraps a handler for an endpoint that exposes device data, so that it only answers requests with
+	 "Authorization: Bearer <AdminToken>". Basic auth with AdminToken as the password is accepted
+	 too, for browsers.
+*/
+
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = auth[len("Bearer "):]
+		} else if _, pass, ok := r.BasicAuth(); ok {
+			token = pass
+		}
+		if len(token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(myConfig.AdminToken)) != 1 {
+			fmt.Printf("401 %s from %s\n", r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="weatherserver"`)
+			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Log entries are returned with Data hex encoded, binary uplinks don't survive JSON strings.
+type logEntryJSON struct {
+	IridiumStore.LogEntry
+	Data string
+}
+
+// /log?imei={IMEI}&from={RFC 3339}&to={RFC 3339}&limit={N}
+
+func handleLogRequest(w http.ResponseWriter, r *http.Request) {
+	q, err := parseLogQuery(r, r.URL.Query().Get("imei"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := store.QueryLog(q)
+	if err != nil {
+		fmt.Printf("log query error: %s\n", err.Error())
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+	ret := make([]logEntryJSON, 0)
+	for _, e := range entries {
+		ret = append(ret, logEntryJSON{LogEntry: e, Data: hex.EncodeToString([]byte(e.Data))})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// /track/{IMEI}.geojson?from={RFC 3339}&to={RFC 3339}
+// /track/{IMEI}.gpx?from={RFC 3339}&to={RFC 3339}
+
+func handleTrackRequest(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	x := strings.Split(path, "/")
+	if len(x) != 2 {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	y := strings.Split(x[1], ".")
+	if len(y) != 2 || len(y[0]) == 0 {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	imei, format := y[0], y[1]
+	if format != "geojson" && format != "gpx" {
+		http.Error(w, "Unknown format, use .geojson or .gpx.", http.StatusBadRequest)
+		return
+	}
+
+	q, err := parseLogQuery(r, imei)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := store.QueryLog(q)
+	if err != nil {
+		fmt.Printf("track query error: %s\n", err.Error())
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+	points := IridiumStore.TrackFromLog(entries)
+
+	var ret []byte
+	if format == "geojson" {
+		ret, err = IridiumStore.MarshalTrackGeoJSON(imei, points)
+		w.Header().Set("Content-Type", "application/geo+json")
+	} else {
+		ret, err = IridiumStore.MarshalTrackGPX(imei, points)
+		w.Header().Set("Content-Type", "application/gpx+xml")
+	}
+	if err != nil {
+		fmt.Printf("track encode error: %s\n", err.Error())
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+	w.Write(ret)
+}
+
+func imeiAllowed(imei string) bool {
+	if len(myConfig.AllowedIMEIs) == 0 {
+		return true
+	}
+	for _, a := range myConfig.AllowedIMEIs {
+		if a == imei {
+			return true
+		}
+	}
+	return false
+}
+
+// forbidden logs and rejects a webhook request.
+func forbidden(w http.ResponseWriter, r *http.Request, msg *RockBLOCK.RockBLOCKCOREIncoming, reason string) {
+	fmt.Printf("403 /receiveRockBLOCK from %s: IMEI %s: MOMSN %s: %s\n", r.RemoteAddr, msg.IMEI, msg.MOMSN, reason)
+	http.Error(w, "Forbidden.", http.StatusForbidden)
+}
+
 // /receiveRockBLOCK
 
 func handleRockBLOCKMsg(w http.ResponseWriter, r *http.Request) {
@@ -69,60 +281,824 @@ func handleRockBLOCKMsg(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Check the message came from RockBLOCK.
+	if jwtKey != nil {
+		form := make(map[string]string, 0)
+		for k, v := range r.Form {
+			form[k] = v[0]
+		}
+		if err := RockBLOCK.VerifyFormJWT(form, jwtKey); err != nil {
+			forbidden(w, r, &msg, err.Error())
+			return
+		}
+	}
+	if !imeiAllowed(msg.IMEI) {
+		forbidden(w, r, &msg, "IMEI not in AllowedIMEIs.")
+		return
+	}
+
+	// Only registered devices are served.
+	dev, err := store.GetDevice(msg.IMEI)
+	if err != nil {
+		fmt.Printf("IMEI %s: device lookup error: %s\n", msg.IMEI, err.Error())
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+	if dev == nil || !dev.Allowed {
+		forbidden(w, r, &msg, "Unknown device.")
+		return
+	}
+
+	// Rock7 retries any delivery that isn't answered with 200. One delivery per device at a time,
+	// so that a retry arriving while the first attempt is still running is seen as a duplicate.
+	unlock := lockIMEI(msg.IMEI)
+	defer unlock()
+
+	// MOMSNs are 16 bit and wrap, so only recent messages count as duplicates.
+	entry, err := store.FindLog(msg.IMEI, msg.MOMSN, time.Now().Add(-MOMSN_REPLAY_WINDOW))
+	if err != nil {
+		fmt.Printf("IMEI %s: MOMSN lookup error: %s\n", msg.IMEI, err.Error())
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+	if entry != nil && entry.State == IridiumStore.LOG_STATE_DONE {
+		fmt.Printf("IMEI %s: MOMSN %s: duplicate delivery, already processed.\n", msg.IMEI, msg.MOMSN)
+		deliveryOK(w)
+		return
+	}
+
 	// Process the message.
-	msg.Process()
+	req, reqErr := msg.Process()
+	if reqErr != nil {
+		fmt.Printf("IMEI %s: %s\n", msg.IMEI, reqErr.Error())
+	}
 
-	x := strings.Split(msg.Data, ",")
-	var TransmitInitTime time.Time
-	var GPSLat string
-	var GPSLng string
+	if entry == nil {
+		// First delivery.
+		entry = &IridiumStore.LogEntry{
+			IMEI:         msg.IMEI,
+			MOMSN:        msg.MOMSN,
+			TransmitTime: msg.TransmitTime,
+			IridiumLat:   msg.IridiumLat,
+			IridiumLng:   msg.IridiumLng,
+			IridiumCEP:   msg.IridiumCEP,
+			Data:         msg.Data,
+			State:        IridiumStore.LOG_STATE_RECEIVED,
+		}
+		if reqErr == nil {
+			entry.TransmitInitTime = req.Time
+			if req.LatLngPresent {
+				entry.GPSLat = strconv.FormatFloat(req.Lat, 'f', 5, 64)
+				entry.GPSLng = strconv.FormatFloat(req.Lng, 'f', 5, 64)
+			}
+		}
+		entry.ID, err = store.InsertLog(*entry)
+		if err != nil {
+			fmt.Printf("error inserting stats row to db: %s\n", err.Error())
+			http.Error(w, "Internal error.", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		fmt.Printf("IMEI %s: MOMSN %s: retried delivery, %d replies already sent.\n", msg.IMEI, msg.MOMSN, entry.RepliesSent)
+	}
 
-	if len(x) == 3 {
-		TransmitInitTime.UnmarshalText([]byte(x[0]))
-		GPSLat = x[1]
-		GPSLng = x[2]
+	// A message that can't be decoded won't decode on a retry either. It's logged, that's all.
+	if reqErr != nil {
+		finishDelivery(w, entry)
+		return
 	}
 
-	_, err := db.Exec(`INSERT INTO log SET IMEI=?, MOMSN=?, TransmitTime=?, IridiumLat=?, IridiumLng=?, IridiumCEP=?, InsertTime=NOW(), TransmitInitTime=?, GPSlat=?, GPSLng=?, Data=?`,
-		msg.IMEI, msg.MOMSN, msg.TransmitTime, msg.IridiumLat, msg.IridiumLng, msg.IridiumCEP, TransmitInitTime, GPSLat, GPSLng, msg.Data)
+	// Answer the request, if it needs an answer.
+	replies, err := dispatcher.Dispatch(&msg, req)
 	if err != nil {
-		fmt.Printf("error inserting stats row to db: %s\n", err.Error())
+		fmt.Printf("IMEI %s: MOMSN %s: %s\n", msg.IMEI, msg.MOMSN, err.Error())
+		if RockBLOCK.IsTemporary(err) {
+			http.Error(w, "Temporarily unavailable.", http.StatusServiceUnavailable)
+			return
+		}
+		finishDelivery(w, entry)
+		return
+	}
+	if entry.RepliesSent < len(replies) {
+		replies = replies[entry.RepliesSent:]
+	} else {
+		replies = nil
+	}
+
+	if len(replies) == 0 {
+		finishDelivery(w, entry)
+		return
+	}
+
+	// Keep within the device's monthly budget. Replies still queued count against it. A multi-part
+	// reply is cut down to the parts that fit, its parts stand on their own.
+	if dev.CreditBudget > 0 {
+		queued, err := store.QueryMT(IridiumStore.MTQuery{IMEI: msg.IMEI, State: IridiumStore.MT_STATE_QUEUED})
+		if err != nil {
+			fmt.Printf("IMEI %s: MT queue lookup error: %s\n", msg.IMEI, err.Error())
+			http.Error(w, "Internal error.", http.StatusInternalServerError)
+			return
+		}
+		available := dev.CreditBudget - dev.CreditsUsed
+		for _, m := range queued {
+			available -= RockBLOCK.MessageCredits(len(m.Data))
+		}
+		n := budgetReplies(replies, available)
+		if n == 0 {
+			fmt.Printf("IMEI %s: MOMSN %s: %d of %d credits left this month (%d used, %d messages queued). Reply not sent.\n", msg.IMEI, msg.MOMSN, available, dev.CreditBudget, dev.CreditsUsed, len(queued))
+			finishDelivery(w, entry)
+			return
+		}
+		if n < len(replies) {
+			fmt.Printf("IMEI %s: MOMSN %s: %d of %d credits left this month. Sending %d of %d replies.\n", msg.IMEI, msg.MOMSN, available, dev.CreditBudget, n, len(replies))
+			replies = replies[:n]
+		}
+	}
+
+	// Replies are sent by runMTQueue().
+	data := make([][]byte, 0)
+	for _, m := range replies {
+		data = append(data, m.Data)
+	}
+	if err := store.QueueMT(entry.ID, msg.IMEI, data); err != nil {
+		fmt.Printf("IMEI %s: MOMSN %s: error queueing replies: %s\n", msg.IMEI, msg.MOMSN, err.Error())
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("IMEI %s: MOMSN %s: queued %d replies to request type %d.\n", msg.IMEI, msg.MOMSN, len(data), req.RequestType)
+	mtQueueWake()
+	deliveryOK(w)
+}
+
+var imeiLocks = make(map[string]*sync.Mutex, 0)
+var imeiLocksMu = &sync.Mutex{}
+
+// lockIMEI serializes delivery handling per device. Returns the unlock function.
+func lockIMEI(imei string) func() {
+	imeiLocksMu.Lock()
+	mu, ok := imeiLocks[imei]
+	if !ok {
+		mu = &sync.Mutex{}
+		imeiLocks[imei] = mu
+	}
+	imeiLocksMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+func deliveryOK(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK\n"))
+}
+
+// finishDelivery marks the log entry as processed, so that retries of it are ignored, and accepts the delivery.
+func finishDelivery(w http.ResponseWriter, entry *IridiumStore.LogEntry) {
+	if err := store.UpdateLogState(entry.ID, IridiumStore.LOG_STATE_DONE, entry.RepliesSent); err != nil {
+		fmt.Printf("IMEI %s: error updating log state: %s\n", entry.IMEI, err.Error())
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
 	}
+	deliveryOK(w)
+}
+
+// budgetReplies is how many of 'replies', from the first, can be sent with 'credits'.
+func budgetReplies(replies []*RockBLOCK.RockBLOCKCOREOutgoing, credits int) int {
+	for i, m := range replies {
+		credits -= m.Credits()
+		if credits < 0 {
+			return i
+		}
+	}
+	return len(replies)
+}
 
-	// See if this is a plaintext weather request.
-	if strings.HasPrefix(msg.Data, "METAR ") {
-		x := strings.Split(msg.Data, " ")
-		metar, err := ADDS.GetLatestADDSMETARs(x[1])
-		if err == nil {
-			m := new(RockBLOCK.RockBLOCKCOREOutgoing)
-			m.IMEI = RockBLOCK.TEST_IMEI
-			m.Data = []byte(metar.Text)
-			if len(m.Data) > 50 {
-				m.Data = m.Data[:50]
+// mtBackoff is how long to wait before retrying a message that has failed 'attempts' times.
+func mtBackoff(attempts int) time.Duration {
+	d := MT_RETRY_BASE
+	for i := 1; i < attempts && d < MT_RETRY_MAX; i++ {
+		d *= 2
+	}
+	if d > MT_RETRY_MAX {
+		d = MT_RETRY_MAX
+	}
+	return d
+}
+
+var mtQueueWakeup = make(chan bool, 1)
+
+// mtQueueWake makes runMTQueue() look at the queue now rather than at the next poll.
+func mtQueueWake() {
+	select {
+	case mtQueueWakeup <- true:
+	default:
+	}
+}
+
+// sendMT makes one attempt at sending 'm' and records the result.
+func sendMT(m IridiumStore.MTMessage) (IridiumStore.MTMessage, error) {
+	out := &RockBLOCK.RockBLOCKCOREOutgoing{IMEI: m.IMEI, Data: m.Data}
+	id, err := out.Send()
+	m.Attempts++
+	if err == nil {
+		m.State = IridiumStore.MT_STATE_SENT
+		m.SentTime = time.Now()
+		m.MessageID = id
+		m.ErrorCode = 0
+		m.Error = ""
+		if err := store.UseDeviceCredits(m.IMEI, out.Credits(), m.SentTime); err != nil {
+			fmt.Printf("IMEI %s: error updating credits: %s\n", m.IMEI, err.Error())
+		}
+		return m, nil
+	}
+
+	m.ErrorCode = 0
+	permanent := false
+	if e, ok := err.(RockBLOCK.COREError); ok {
+		m.ErrorCode = e.Code
+		permanent = e.Permanent()
+	}
+	m.Error = err.Error()
+	if len(m.Error) > MT_ERROR_MAX_LEN {
+		m.Error = m.Error[:MT_ERROR_MAX_LEN]
+	}
+	if permanent || m.Attempts >= MT_MAX_ATTEMPTS {
+		m.State = IridiumStore.MT_STATE_FAILED
+	} else {
+		m.NextAttempt = time.Now().Add(mtBackoff(m.Attempts))
+	}
+	return m, err
+}
+
+/*
+	runMTQueue().
+	 Sends queued MT messages, retrying failures with exponential backoff. Messages to a device
+	 go out in the order they were queued - a device's later messages wait while an earlier
+	 one is waiting to be retried, so multi-part replies arrive in sequence.
+*/
+
+func runMTQueue() {
+	for {
+		pending, err := store.PendingMT()
+		if err != nil {
+			fmt.Printf("MT queue error: %s\n", err.Error())
+		}
+		now := time.Now()
+		blocked := make(map[string]bool, 0)
+		for _, m := range pending {
+			if blocked[m.IMEI] {
+				continue
 			}
-			a, err := m.Send()
-			fmt.Printf("attempt to send METAR %s\n", m.Data)
+			if m.NextAttempt.After(now) {
+				blocked[m.IMEI] = true
+				continue
+			}
+			m, err := sendMT(m)
 			if err != nil {
-				fmt.Printf("a=%s, err=%s\n", a, err.Error())
+				fmt.Printf("IMEI %s: MT %d: attempt %d failed: %s\n", m.IMEI, m.ID, m.Attempts, err.Error())
+				if m.State == IridiumStore.MT_STATE_QUEUED {
+					blocked[m.IMEI] = true
+				} else {
+					fmt.Printf("IMEI %s: MT %d: giving up.\n", m.IMEI, m.ID)
+				}
 			} else {
-				fmt.Printf("a=%s\n", a)
+				fmt.Printf("IMEI %s: MT %d: sent, message ID %s.\n", m.IMEI, m.ID, m.MessageID)
+			}
+			if err := store.UpdateMT(m); err != nil {
+				// Not recorded as sent, it will be sent again.
+				fmt.Printf("IMEI %s: MT %d: error updating queue: %s\n", m.IMEI, m.ID, err.Error())
+				blocked[m.IMEI] = true
+			}
+		}
+
+		select {
+		case <-mtQueueWakeup:
+		case <-time.After(MT_QUEUE_POLL):
+		}
+	}
+}
+
+var mtStateNames = map[int]string{
+	IridiumStore.MT_STATE_QUEUED: "queued",
+	IridiumStore.MT_STATE_SENT:   "sent",
+	IridiumStore.MT_STATE_FAILED: "failed",
+}
+
+// Queued messages are returned with Data hex encoded and State by name.
+type mtMessageJSON struct {
+	IridiumStore.MTMessage
+	Data  string
+	State string
+}
+
+// /mtqueue?imei={IMEI}&state={queued|sent|failed}&limit={N}
+
+func handleMTQueueRequest(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	q := IridiumStore.MTQuery{IMEI: v.Get("imei"), State: -1, Limit: LOG_QUERY_DEFAULT_LIMIT}
+	if s := v.Get("state"); len(s) > 0 {
+		q.State = -2
+		for state, name := range mtStateNames {
+			if name == s {
+				q.State = state
 			}
 		}
+		if q.State == -2 {
+			http.Error(w, "Invalid 'state', must be queued, sent or failed.", http.StatusBadRequest)
+			return
+		}
 	}
+	if s := v.Get("limit"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > LOG_QUERY_MAX_LIMIT {
+			http.Error(w, fmt.Sprintf("Invalid 'limit', must be 1-%d.", LOG_QUERY_MAX_LIMIT), http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+	msgs, err := store.QueryMT(q)
+	if err != nil {
+		fmt.Printf("MT queue query error: %s\n", err.Error())
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+	ret := make([]mtMessageJSON, 0)
+	for _, m := range msgs {
+		ret = append(ret, mtMessageJSON{MTMessage: m, Data: hex.EncodeToString(m.Data), State: mtStateNames[m.State]})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+/*
+	requestPosition().
+	 Position the request was sent from. Uses the GPS position in the message if there is one,
+	 otherwise the (much less accurate) position reported by the Iridium network.
+*/
+
+func requestPosition(in *RockBLOCK.RockBLOCKCOREIncoming, req RockBLOCK.IridiumMessage) (*geo.Point, error) {
+	if req.LatLngPresent {
+		return geo.NewPoint(req.Lat, req.Lng), nil
+	}
+	lat, err1 := strconv.ParseFloat(in.IridiumLat, 64)
+	lng, err2 := strconv.ParseFloat(in.IridiumLng, 64)
+	if err1 != nil || err2 != nil {
+		return nil, errors.New("No position in request.")
+	}
+	return geo.NewPoint(lat, lng), nil
+}
+
+// fitLines joins as many of 'lines' as fit in one MT message. A first line that doesn't fit on its own is
+// cut to MAX_MT_SZ, so there is always a reply if there are lines.
+func fitLines(lines []string) []byte {
+	ret := make([]byte, 0)
+	for _, l := range lines {
+		n := len(l)
+		if len(ret) > 0 {
+			n++ // Newline.
+		}
+		if len(ret) == 0 && n > RockBLOCK.MAX_MT_SZ {
+			return []byte(l[:RockBLOCK.MAX_MT_SZ])
+		}
+		if len(ret)+n > RockBLOCK.MAX_MT_SZ {
+			break
+		}
+		if len(ret) > 0 {
+			ret = append(ret, '\n')
+		}
+		ret = append(ret, []byte(l)...)
+	}
+	return ret
+}
+
+func requestIdent(req RockBLOCK.IridiumMessage) (string, error) {
+	ident := strings.ToUpper(strings.TrimSpace(string(req.Data)))
+	if len(ident) == 0 {
+		return "", errors.New("No identifier in request.")
+	}
+	return ident, nil
+}
+
+/*
+	splitSequenced().
+	 Joins 'entries' with spaces into as few MT messages as possible. If more than one is needed,
+	 each starts with its sequence number and the total, e.g. "1/3 ".
+*/
+
+func splitSequenced(entries []string) [][]byte {
+	parts := make([]string, 0)
+	cur := ""
+	for _, e := range entries {
+		if len(cur) > 0 && len(cur)+1+len(e) > RockBLOCK.MAX_MT_SZ-SEQUENCE_HEADER_MAX {
+			parts = append(parts, cur)
+			cur = ""
+		}
+		if len(cur) > 0 {
+			cur += " "
+		}
+		cur += e
+	}
+	if len(cur) > 0 {
+		parts = append(parts, cur)
+	}
+
+	ret := make([][]byte, 0)
+	for i, p := range parts {
+		if len(parts) > 1 {
+			p = fmt.Sprintf("%d/%d %s", i+1, len(parts), p)
+		}
+		ret = append(ret, []byte(p))
+	}
+	return ret
+}
+
+func handleNilUplink(in *RockBLOCK.RockBLOCKCOREIncoming, req RockBLOCK.IridiumMessage) ([]byte, error) {
+	return nil, nil
+}
+
+func handlePingUplink(in *RockBLOCK.RockBLOCKCOREIncoming, req RockBLOCK.IridiumMessage) ([]byte, error) {
+	return []byte("PONG " + time.Now().UTC().Format("150405Z")), nil
+}
+
+func handleMETARUplink(in *RockBLOCK.RockBLOCKCOREIncoming, req RockBLOCK.IridiumMessage) ([]byte, error) {
+	ident, err := requestIdent(req)
+	if err != nil {
+		return nil, err
+	}
+	metar, err := ADDS.GetLatestADDSMETARs(ident)
+	if err != nil {
+		return nil, RockBLOCK.TemporaryError{Err: err}
+	}
+	dev, err := store.GetDevice(in.IMEI)
+	if err != nil {
+		return nil, err
+	}
+	if dev != nil && dev.ReplyFormat == REPLY_FORMAT_PACKED {
+		// Falls back to text if it can't be parsed.
+		if packed, err := packMETARReply(metar.Text); err == nil {
+			return packed, nil
+		}
+	}
+	return []byte(metar.Text), nil
+}
+
+// packMETARReply packs one METAR for a reply as: station identifier (4 bytes), length (1 byte), PackMETAR() output.
+func packMETARReply(text string) ([]byte, error) {
+	m, err := WeatherPack.ParseMETAR(text)
+	if err != nil {
+		return nil, err
+	}
+	packed, err := WeatherPack.PackMETAR(m)
+	if err != nil {
+		return nil, err
+	}
+	ret := append([]byte(m.StationID), byte(len(packed)))
+	return append(ret, packed...), nil
+}
+
+/*
+	handleNearestWeatherUplink().
+	 Replies with the METARs of the stations closest to the sender, nearest first, each packed by
+	 packMETARReply(). As many as fit in one MT message, up to the number requested.
+*/
+
+func handleNearestWeatherUplink(in *RockBLOCK.RockBLOCKCOREIncoming, req RockBLOCK.IridiumMessage) ([]byte, error) {
+	if airportDB == nil {
+		return nil, errors.New("No airport database.")
+	}
+	n := NEAREST_WEATHER_DEFAULT
+	if len(req.Data) > 0 && req.Data[0] > 0 {
+		n = int(req.Data[0])
+	}
+	pos, err := requestPosition(in, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]byte, 0)
+	count, lookups := 0, 0
+	for _, a := range airportDB.FindClosestAirports(pos.Lat(), pos.Lng()) {
+		// Most airports don't report METARs, don't query ADDS for every one of them.
+		if count >= n || lookups >= NEAREST_WEATHER_MAX_LOOKUPS {
+			break
+		}
+		lookups++
+		metar, err := ADDS.GetLatestADDSMETARs(a.ThisAirport.Ident)
+		if err != nil || len(metar.Text) == 0 {
+			continue
+		}
+		packed, err := packMETARReply(metar.Text)
+		if err != nil {
+			fmt.Printf("nearest weather: %s: %s\n", a.ThisAirport.Ident, err.Error())
+			continue
+		}
+		if len(ret)+len(packed) > RockBLOCK.MAX_MT_SZ {
+			break
+		}
+		ret = append(ret, packed...)
+		count++
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("No METARs near %f,%f.", pos.Lat(), pos.Lng())
+	}
+	return ret, nil
+}
+
+// TAFs are sent compacted, and split into sequenced parts if still longer than MAX_MT_SZ.
+func handleTAFUplink(in *RockBLOCK.RockBLOCKCOREIncoming, req RockBLOCK.IridiumMessage) ([][]byte, error) {
+	ident, err := requestIdent(req)
+	if err != nil {
+		return nil, err
+	}
+	tafs, err := ADDS.GetADDSTAFsByIdent(ident)
+	if err != nil {
+		return nil, RockBLOCK.TemporaryError{Err: err}
+	}
+	if len(tafs) == 0 {
+		return [][]byte{[]byte("NO TAF " + ident)}, nil
+	}
+	text := tafs[0].Text
+	if taf, err := WeatherText.ParseTAF(text, time.Now()); err == nil {
+		text = taf.Compact(time.Now())
+	}
+	return splitSequenced(strings.Fields(text)), nil
+}
+
+func handlePIREPUplink(in *RockBLOCK.RockBLOCKCOREIncoming, req RockBLOCK.IridiumMessage) ([]byte, error) {
+	pos, err := requestPosition(in, req)
+	if err != nil {
+		return nil, err
+	}
+	pireps, err := ADDS.GetLatestADDSPIREPsInRadiusOf(PIREP_REQUEST_RADIUS, pos)
+	if err != nil {
+		return nil, RockBLOCK.TemporaryError{Err: err}
+	}
+	if len(pireps) == 0 {
+		return []byte("NO PIREPS"), nil
+	}
+	lines := make([]string, 0)
+	for _, p := range pireps {
+		lines = append(lines, p.Text)
+	}
+	return fitLines(lines), nil
+}
+
+/*
+	handleWindsAloftUplink().
+	 Replies with the FD forecast header and the line for the requested station, e.g.:
+	  FT  3000    6000    9000   12000   18000   24000  30000  34000  39000
+	  DTW 2213 2317+07 2422+02 2530-04 2547-16 2559-28 267443 268152 269056
+*/
+
+func handleWindsAloftUplink(in *RockBLOCK.RockBLOCKCOREIncoming, req RockBLOCK.IridiumMessage) ([]byte, error) {
+	ident, err := requestIdent(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(ident) == 4 && (ident[0] == 'K' || ident[0] == 'C') {
+		ident = ident[1:] // FD stations are 3 letter identifiers.
+	}
+
+	resp, err := http.Get(WINDS_ALOFT_URL)
+	if err != nil {
+		return nil, RockBLOCK.TemporaryError{Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, RockBLOCK.TemporaryError{Err: fmt.Errorf("Winds aloft: %s.", resp.Status)}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, RockBLOCK.TemporaryError{Err: err}
+	}
+
+	var header string
+	for _, l := range strings.Split(string(body), "\n") {
+		l = strings.TrimRight(l, "\r ")
+		if strings.HasPrefix(l, "FT ") {
+			header = l
+		}
+		if strings.HasPrefix(l, ident+" ") {
+			return fitLines([]string{header, l}), nil
+		}
+	}
+	return []byte("NO FD " + ident), nil
+}
+
+func handleAirportsUplink(in *RockBLOCK.RockBLOCKCOREIncoming, req RockBLOCK.IridiumMessage) ([]byte, error) {
+	if airportDB == nil {
+		return nil, errors.New("No airport database.")
+	}
+	pos, err := requestPosition(in, req)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, 0)
+	for _, a := range airportDB.FindClosestAirports(pos.Lat(), pos.Lng()) {
+		if len(lines) >= AIRPORTS_REQUEST_MAX {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%s %.0f", a.ThisAirport.Ident, a.Distance))
+	}
+	return fitLines(lines), nil
+}
+
+// flightCategoryCodes shortens ADDS flight categories for route replies.
+var flightCategoryCodes = map[string]string{
+	"VFR":  "V",
+	"MVFR": "M",
+	"IFR":  "I",
+	"LIFR": "L",
+}
+
+/*
+	handleRouteWeatherUplink().
+	 Replies with the flight category of each station along the route, e.g.:
+	  KDTW=V KYIP=M KARB=I
+	 Stations without a flight category are sent as "?".
+*/
+
+func handleRouteWeatherUplink(in *RockBLOCK.RockBLOCKCOREIncoming, req RockBLOCK.IridiumMessage) ([][]byte, error) {
+	if len(req.Data) < 2 {
+		return nil, errors.New("No route in request.")
+	}
+	width := float64(req.Data[0])
+	if width == 0 {
+		width = ROUTE_WEATHER_DEFAULT_WIDTH
+	}
+	route := strings.ToUpper(strings.TrimSpace(string(req.Data[1:])))
+	for _, c := range route {
+		if !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != ';' {
+			return nil, fmt.Errorf("Invalid route '%s'.", route)
+		}
+	}
+
+	metars, err := ADDS.GetLatestADDSMETARsAlongRoute(width, route)
+	if err != nil {
+		return nil, RockBLOCK.TemporaryError{Err: err}
+	}
+	if len(metars) == 0 {
+		return [][]byte{[]byte("NO METARS " + route)}, nil
+	}
+
+	entries := make([]string, 0)
+	seen := make(map[string]bool, 0)
+	for _, m := range metars {
+		if seen[m.StationID] {
+			continue
+		}
+		seen[m.StationID] = true
+		cat, ok := flightCategoryCodes[m.FlightCategory]
+		if !ok {
+			cat = "?"
+		}
+		entries = append(entries, m.StationID+"="+cat)
+	}
+	return splitSequenced(entries), nil
+}
 
+func initDispatcher() {
+	dispatcher = RockBLOCK.NewDispatcher()
+	dispatcher.Register(RockBLOCK.REQUEST_NIL, handleNilUplink)
+	dispatcher.Register(RockBLOCK.REQUEST_METAR, handleMETARUplink)
+	dispatcher.RegisterMulti(RockBLOCK.REQUEST_TAF, handleTAFUplink)
+	dispatcher.Register(RockBLOCK.REQUEST_PIREP, handlePIREPUplink)
+	dispatcher.Register(RockBLOCK.REQUEST_WINDS_ALOFT, handleWindsAloftUplink)
+	dispatcher.Register(RockBLOCK.REQUEST_AIRPORTS, handleAirportsUplink)
+	dispatcher.Register(RockBLOCK.REQUEST_PING, handlePingUplink)
+	dispatcher.Register(RockBLOCK.REQUEST_NEAREST_WEATHER, handleNearestWeatherUplink)
+	dispatcher.RegisterMulti(RockBLOCK.REQUEST_ROUTE_WEATHER, handleRouteWeatherUplink)
+}
+
+/*
+	loadConfig().
+	 Reads 'path' (JSON, see weatherserver.json.example) then applies environment overrides.
+	 A missing file is not an error, everything can come from the environment.
+*/
+
+func loadConfig(path string) (ServerConfig, error) {
+	c := ServerConfig{ListenAddress: ":8080"}
+	fp, err := os.Open(path)
+	if err == nil {
+		defer fp.Close()
+		if err := json.NewDecoder(fp).Decode(&c); err != nil {
+			return c, fmt.Errorf("Couldn't read '%s': %s", path, err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return c, err
+	}
+
+	if v := os.Getenv(ENV_DSN); len(v) > 0 {
+		c.DSN = v
+	}
+	if v := os.Getenv(ENV_LISTEN_ADDRESS); len(v) > 0 {
+		c.ListenAddress = v
+	}
+	if v := os.Getenv(ENV_TLS_CERT); len(v) > 0 {
+		c.TLSCert = v
+	}
+	if v := os.Getenv(ENV_TLS_KEY); len(v) > 0 {
+		c.TLSKey = v
+	}
+	if v := os.Getenv(ENV_JWT_KEY); len(v) > 0 {
+		c.JWTPublicKey = v
+	}
+	if v := os.Getenv(ENV_ALLOWED_IMEIS); len(v) > 0 {
+		c.AllowedIMEIs = strings.Split(v, ",")
+	}
+	if v := os.Getenv(ENV_ADMIN_TOKEN); len(v) > 0 {
+		c.AdminToken = v
+	}
+	c.RockBLOCK.ApplyEnv()
+
+	// Validate.
+	if len(c.DSN) == 0 {
+		return c, fmt.Errorf("No database DSN. Set DSN in '%s' or %s.", path, ENV_DSN)
+	}
+	if len(c.ListenAddress) == 0 {
+		return c, errors.New("No listen address.")
+	}
+	if (len(c.TLSCert) == 0) != (len(c.TLSKey) == 0) {
+		return c, errors.New("TLSCert and TLSKey must be set together.")
+	}
+	for _, f := range []string{c.TLSCert, c.TLSKey} {
+		if len(f) == 0 {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return c, fmt.Errorf("TLS: %s", err.Error())
+		}
+	}
+	for i, imei := range c.AllowedIMEIs {
+		c.AllowedIMEIs[i] = strings.TrimSpace(imei)
+		if len(c.AllowedIMEIs[i]) != 15 {
+			return c, fmt.Errorf("Invalid IMEI '%s' in AllowedIMEIs.", imei)
+		}
+	}
+	if len(c.AdminToken) > 0 && len(c.AdminToken) < ADMIN_TOKEN_MIN_LEN {
+		return c, fmt.Errorf("AdminToken must be at least %d characters.", ADMIN_TOKEN_MIN_LEN)
+	}
+	if err := c.RockBLOCK.Validate(); err != nil {
+		return c, err
+	}
+	return c, nil
 }
 
 func main() {
-	db2, err := sql.Open("mysql", "root:@/iridium")
+	configFile := flag.String("config", "weatherserver.json", "Config file.")
+	dbBackend := flag.String("db", "mysql", "Message log backend, 'mysql' or 'sqlite'. The DSN is a file path for 'sqlite'.")
+	flag.Parse()
+
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Printf("config error: %s\n", err.Error())
+		return
+	}
+	myConfig = c
+	RockBLOCK.SetConfig(myConfig.RockBLOCK)
+
+	if len(myConfig.JWTPublicKey) > 0 {
+		keyPEM, err := ioutil.ReadFile(myConfig.JWTPublicKey)
+		if err != nil {
+			fmt.Printf("config error: %s\n", err.Error())
+			return
+		}
+		jwtKey, err = RockBLOCK.ParsePublicKey(keyPEM)
+		if err != nil {
+			fmt.Printf("config error: %s\n", err.Error())
+			return
+		}
+	} else {
+		fmt.Printf("warning: no JWTPublicKey, /receiveRockBLOCK signatures are not checked.\n")
+	}
+
+	store, err = IridiumStore.Open(*dbBackend, myConfig.DSN)
 	if err != nil {
-		fmt.Printf("dbWriter(): db connect error: %s\n", err.Error())
+		fmt.Printf("db error: %s\n", err.Error())
 		return
 	}
-	db = db2
+	defer store.Close()
+
+	airportDB, err = ADDS.NewAirportDB("./airports.sqlite3")
+	if err != nil {
+		fmt.Printf("airport db error: %s\n", err.Error())
+	}
+	initDispatcher()
 
 	http.HandleFunc("/metar/", handleMETARRequest)
 	http.HandleFunc("/receiveRockBLOCK", handleRockBLOCKMsg)
-	err = http.ListenAndServe(":8080", nil)
+	if len(myConfig.AdminToken) > 0 {
+		http.HandleFunc("/log", requireAdmin(handleLogRequest))
+		http.HandleFunc("/track/", requireAdmin(handleTrackRequest))
+		http.HandleFunc("/mtqueue", requireAdmin(handleMTQueueRequest))
+	} else {
+		fmt.Printf("warning: no AdminToken, /log, /track/ and /mtqueue are disabled.\n")
+	}
+	go runMTQueue()
+	if len(myConfig.TLSCert) > 0 {
+		err = http.ListenAndServeTLS(myConfig.ListenAddress, myConfig.TLSCert, myConfig.TLSKey, nil)
+	} else {
+		err = http.ListenAndServe(myConfig.ListenAddress, nil)
+	}
 	if err != nil {
 		fmt.Printf("managementInterface ListenAndServe: %s\n", err.Error())
 	}